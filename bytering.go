@@ -0,0 +1,342 @@
+// bytering.go - Byte ring buffer with io.Reader/io.Writer semantics
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Notes:
+//   - rd and wr are free running byte counters; the buffer index is
+//     'ctr & mask'. Thus, all N bytes of the buffer are usable.
+//   - reads and writes copy at most two contiguous chunks.
+
+// ByteRing is a fixed-size ring buffer of bytes that implements
+// io.Reader, io.Writer, io.ByteReader, io.ByteWriter and io.WriterTo.
+// The buffer always has a power-of-2 size. ByteRing is not
+// thread-safe; see SyncByteRing for a blocking, thread-safe version.
+type ByteRing struct {
+	rd, wr uint64
+	mask   uint64
+	b      []byte
+}
+
+var (
+	_ io.Reader     = &ByteRing{}
+	_ io.Writer     = &ByteRing{}
+	_ io.ByteReader = &ByteRing{}
+	_ io.ByteWriter = &ByteRing{}
+	_ io.WriterTo   = &ByteRing{}
+)
+
+// Make a new byte ring to hold (at least) 'n' bytes. If 'n' is NOT a
+// power-of-2, this function will pick the next closest power-of-2.
+func NewByteRing(n int) *ByteRing {
+	r := &ByteRing{}
+	r.init(n)
+	return r
+}
+
+func (r *ByteRing) init(n int) {
+	z := nextpow2(uint64(n)) //#nosec G115 -- 64 bit platforms
+
+	r.rd, r.wr = 0, 0
+	r.mask = z - 1
+	r.b = make([]byte, z)
+}
+
+// Write copies as much of 'p' as will fit into the ring; if all of
+// 'p' doesn't fit, it returns io.ErrShortWrite.
+func (r *ByteRing) Write(p []byte) (int, error) {
+	free := uint64(len(r.b)) - (r.wr - r.rd)
+	n := min(uint64(len(p)), free)
+
+	i := r.wr & r.mask
+	k := copy(r.b[i:], p[:n])
+	copy(r.b, p[k:n])
+	r.wr += n
+
+	if n < uint64(len(p)) {
+		return int(n), io.ErrShortWrite //#nosec G115 -- n <= len(p)
+	}
+	return int(n), nil //#nosec G115 -- n <= len(p)
+}
+
+// WriteByte writes a single byte; it returns io.ErrShortWrite if the
+// ring is full.
+func (r *ByteRing) WriteByte(c byte) error {
+	if r.wr-r.rd == uint64(len(r.b)) {
+		return io.ErrShortWrite
+	}
+
+	r.b[r.wr&r.mask] = c
+	r.wr++
+	return nil
+}
+
+// Read reads up to len(p) bytes from the ring; it returns io.EOF if
+// the ring is empty.
+func (r *ByteRing) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n := min(uint64(len(p)), r.wr-r.rd)
+	if n == 0 {
+		return 0, io.EOF
+	}
+
+	i := r.rd & r.mask
+	k := copy(p[:n], r.b[i:])
+	copy(p[k:n], r.b)
+	r.rd += n
+	return int(n), nil //#nosec G115 -- n <= len(p)
+}
+
+// ReadByte reads a single byte; it returns io.EOF if the ring is
+// empty.
+func (r *ByteRing) ReadByte() (byte, error) {
+	if r.rd == r.wr {
+		return 0, io.EOF
+	}
+
+	c := r.b[r.rd&r.mask]
+	r.rd++
+	return c, nil
+}
+
+// WriteTo writes the contents of the ring to 'w' until the ring is
+// empty or 'w' returns an error.
+func (r *ByteRing) WriteTo(w io.Writer) (int64, error) {
+	var t int64
+
+	for r.rd != r.wr {
+		// the largest contiguous chunk
+		i := r.rd & r.mask
+		j := min(uint64(len(r.b)), i+(r.wr-r.rd))
+
+		n, err := w.Write(r.b[i:j])
+		r.rd += uint64(n) //#nosec G115 -- n is never negative
+		t += int64(n)
+		if err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// Reset empties the ring
+func (r *ByteRing) Reset() {
+	r.rd, r.wr = 0, 0
+}
+
+// Len returns the number of unread bytes in the ring
+func (r *ByteRing) Len() int {
+	return int(r.wr - r.rd) //#nosec G115 -- bounded by the size
+}
+
+// Size returns the capacity of the ring
+func (r *ByteRing) Size() int {
+	return len(r.b)
+}
+
+// String returns a human readable description of the ring
+func (r *ByteRing) String() string {
+	return r.repr("ByteRing")
+}
+
+func (r *ByteRing) repr(nm string) string {
+	suff := qrepr(r.rd, r.wr, uint64(len(r.b)))
+	return fmt.Sprintf("<%s %s>", nm, suff)
+}
+
+// SyncByteRing is a thread-safe ByteRing with blocking reads and
+// writes; it can be used as a buffered, in-process pipe. Read blocks
+// until data is available and Write blocks until all of its input is
+// written. CloseWrite signals EOF to the readers and Close signals
+// the writers that there are no more readers.
+type SyncByteRing struct {
+	sync.Mutex
+	r ByteRing
+
+	rclosed bool
+	wclosed bool
+
+	rdable waitq
+	wrable waitq
+}
+
+var (
+	_ io.ReadWriteCloser = &SyncByteRing{}
+	_ io.ByteReader      = &SyncByteRing{}
+	_ io.ByteWriter      = &SyncByteRing{}
+	_ io.WriterTo        = &SyncByteRing{}
+)
+
+// Make a new thread-safe byte ring to hold (at least) 'n' bytes. If
+// 'n' is NOT a power-of-2, this function will pick the next closest
+// power-of-2.
+func NewSyncByteRing(n int) *SyncByteRing {
+	r := &SyncByteRing{}
+	r.r.init(n)
+	return r
+}
+
+// Write writes all of 'p' to the ring, blocking until there is space.
+// It returns io.ErrClosedPipe if the ring is closed for reading or
+// writing.
+func (r *SyncByteRing) Write(p []byte) (int, error) {
+	var t int
+
+	r.Lock()
+	for {
+		if r.rclosed || r.wclosed {
+			r.Unlock()
+			return t, io.ErrClosedPipe
+		}
+
+		n, _ := r.r.Write(p[t:])
+		if n > 0 {
+			t += n
+			r.rdable.wakeup()
+		}
+		if t == len(p) {
+			r.Unlock()
+			return t, nil
+		}
+
+		ch := r.wrable.wait()
+		r.Unlock()
+		<-ch
+		r.Lock()
+	}
+}
+
+// WriteByte writes a single byte, blocking until there is space
+func (r *SyncByteRing) WriteByte(c byte) error {
+	_, err := r.Write([]byte{c})
+	return err
+}
+
+// Read reads up to len(p) bytes, blocking until some data is
+// available. It returns io.EOF once the ring is empty and closed for
+// writing.
+func (r *SyncByteRing) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	r.Lock()
+	for {
+		if r.rclosed {
+			r.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+
+		if n, _ := r.r.Read(p); n > 0 {
+			r.wrable.wakeup()
+			r.Unlock()
+			return n, nil
+		}
+
+		if r.wclosed {
+			r.Unlock()
+			return 0, io.EOF
+		}
+
+		ch := r.rdable.wait()
+		r.Unlock()
+		<-ch
+		r.Lock()
+	}
+}
+
+// ReadByte reads a single byte, blocking until it is available
+func (r *SyncByteRing) ReadByte() (byte, error) {
+	var b [1]byte
+
+	if _, err := r.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// WriteTo copies data from the ring to 'w' until the ring is empty
+// and closed for writing, or 'w' returns an error.
+func (r *SyncByteRing) WriteTo(w io.Writer) (int64, error) {
+	var t int64
+
+	buf := make([]byte, min(32*1024, r.r.Size()))
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			t += int64(m)
+			if werr != nil {
+				return t, werr
+			}
+		}
+
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return t, err
+		}
+	}
+}
+
+// CloseWrite closes the writing side of the ring; readers get io.EOF
+// once they drain the ring.
+func (r *SyncByteRing) CloseWrite() error {
+	r.Lock()
+	r.wclosed = true
+	r.rdable.wakeup()
+	r.wrable.wakeup()
+	r.Unlock()
+	return nil
+}
+
+// Close closes the ring for both reading and writing; blocked readers
+// and writers get io.ErrClosedPipe.
+func (r *SyncByteRing) Close() error {
+	r.Lock()
+	r.rclosed = true
+	r.wclosed = true
+	r.rdable.wakeup()
+	r.wrable.wakeup()
+	r.Unlock()
+	return nil
+}
+
+// Len returns the number of unread bytes in the ring
+func (r *SyncByteRing) Len() int {
+	r.Lock()
+	n := r.r.Len()
+	r.Unlock()
+	return n
+}
+
+// Size returns the capacity of the ring
+func (r *SyncByteRing) Size() int {
+	return r.r.Size()
+}
+
+// String returns a human readable description of the ring
+func (r *SyncByteRing) String() string {
+	r.Lock()
+	s := r.r.repr("SyncByteRing")
+	r.Unlock()
+	return s
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
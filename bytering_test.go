@@ -0,0 +1,158 @@
+// bytering_test.go - tests for byte rings
+
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestByteRing(t *testing.T) {
+	assert := newAsserter(t)
+
+	r := NewByteRing(7)
+	assert(r.Size() == 8, "size: exp 8, saw %d", r.Size())
+
+	var buf [8]byte
+	n, err := r.Read(buf[:])
+	assert(n == 0 && err == io.EOF, "read on empty ring: %d, %v", n, err)
+
+	n, err = r.Write([]byte("hello"))
+	assert(n == 5 && err == nil, "write: %d, %v", n, err)
+
+	n, err = r.Read(buf[:3])
+	assert(n == 3 && err == nil, "read: %d, %v", n, err)
+	assert(string(buf[:3]) == "hel", "read: saw %q", buf[:3])
+
+	// this write wraps around and is short
+	n, err = r.Write([]byte("0123456789"))
+	assert(n == 6 && err == io.ErrShortWrite, "write: %d, %v", n, err)
+	assert(r.Len() == 8, "len: exp 8, saw %d", r.Len())
+
+	err = r.WriteByte('x')
+	assert(err == io.ErrShortWrite, "writebyte on full ring: %v", err)
+
+	c, err := r.ReadByte()
+	assert(err == nil && c == 'l', "readbyte: %q, %v", c, err)
+	assert(r.WriteByte('x') == nil, "writebyte failed")
+
+	n, err = r.Read(buf[:])
+	assert(n == 8 && err == nil, "read: %d, %v", n, err)
+	assert(string(buf[:n]) == "o012345x", "read: saw %q", buf[:n])
+
+	// WriteTo across the wrap point
+	r.Write([]byte("abcdef"))
+	var w bytes.Buffer
+	m, err := r.WriteTo(&w)
+	assert(err == nil && m == 6, "writeto: %d, %v", m, err)
+	assert(w.String() == "abcdef", "writeto: saw %q", w.String())
+	assert(r.Len() == 0, "len: exp 0, saw %d", r.Len())
+}
+
+func TestSyncByteRing(t *testing.T) {
+	assert := newAsserter(t)
+
+	data := make([]byte, 1024*1024+17)
+	rand.Read(data)
+
+	r := NewSyncByteRing(4096)
+	go func() {
+		// odd sized writes to exercise the wrap around
+		for b := data; len(b) > 0; {
+			n := min(len(b), 1013)
+			if _, err := r.Write(b[:n]); err != nil {
+				t.Errorf("write: %s", err)
+				return
+			}
+			b = b[n:]
+		}
+		r.CloseWrite()
+	}()
+
+	var w bytes.Buffer
+	n, err := io.Copy(&w, r)
+	assert(err == nil, "copy: %v", err)
+	assert(n == int64(len(data)), "copy: exp %d bytes, saw %d", len(data), n)
+	assert(bytes.Equal(w.Bytes(), data), "copy: data mismatch")
+
+	_, err = r.Read(make([]byte, 1))
+	assert(err == io.EOF, "read after closewrite: exp EOF, saw %v", err)
+	_, err = r.Write([]byte("x"))
+	assert(err == io.ErrClosedPipe, "write after closewrite: saw %v", err)
+}
+
+func TestSyncByteRingClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	r := NewSyncByteRing(4)
+	done := make(chan error)
+	go func() {
+		_, err := r.Write([]byte("0123456789"))
+		done <- err
+	}()
+
+	c, err := r.ReadByte()
+	assert(err == nil && c == '0', "readbyte: %q, %v", c, err)
+
+	// Close must wake up the blocked writer
+	r.Close()
+	select {
+	case err := <-done:
+		assert(err == io.ErrClosedPipe, "write: exp ErrClosedPipe, saw %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("writer not woken up by close")
+	}
+}
+
+// BenchmarkPipe compares SyncByteRing as an in-process pipe against
+// io.Pipe for a range of write sizes.
+func BenchmarkPipe(b *testing.B) {
+	for _, sz := range []int{64, 1024, 16 * 1024} {
+		b.Run(fmt.Sprintf("SyncByteRing/%d", sz), func(b *testing.B) {
+			r := NewSyncByteRing(64 * 1024)
+			benchPipe(b, r, r, r.CloseWrite, sz)
+		})
+		b.Run(fmt.Sprintf("io.Pipe/%d", sz), func(b *testing.B) {
+			pr, pw := io.Pipe()
+			benchPipe(b, pr, pw, pw.Close, sz)
+		})
+	}
+}
+
+// benchPipe writes b.N chunks of 'sz' bytes to 'w' from another
+// go-routine and reads them back from 'r'.
+func benchPipe(b *testing.B, r io.Reader, w io.Writer, closew func() error, sz int) {
+	src := make([]byte, sz)
+	dst := make([]byte, sz)
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.Write(src); err != nil {
+				break
+			}
+		}
+		closew()
+	}()
+
+	b.SetBytes(int64(sz))
+	b.ResetTimer()
+
+	var t int
+	for {
+		n, err := r.Read(dst)
+		t += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.Fatalf("read: %v", err)
+		}
+	}
+	if want := b.N * sz; t != want {
+		b.Fatalf("read: exp %d bytes, saw %d", want, t)
+	}
+}
@@ -0,0 +1,187 @@
+// chanq.go - Bridges between channels and queues
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// Enqueuer is the producer side of a queue
+type Enqueuer[T any] interface {
+	// Enq enqueues 'x' and returns false if the queue is full
+	Enq(x T) bool
+}
+
+// Dequeuer is the consumer side of a queue
+type Dequeuer[T any] interface {
+	// Deq dequeues the oldest element and returns false if
+	// the queue is empty
+	Deq() (T, bool)
+}
+
+// waitDequeuer is implemented by queues that can block consumers
+type waitDequeuer[T any] interface {
+	DeqWait(ctx context.Context) (T, error)
+}
+
+// blockingEnqueuer is implemented by queues whose Enq can block on a
+// full queue (the Block policy)
+type blockingEnqueuer[T any] interface {
+	EnqWait(ctx context.Context, x T) error
+	blocks() bool
+}
+
+// idler is implemented by queues whose DeqWait may spin instead of
+// giving up the CPU (e.g., SPSCQ).
+type idler interface {
+	idles() bool
+}
+
+// FromChan enqueues every element received on 'ch' into 'q' until
+// 'ch' is closed or the context is done. Elements that can't be
+// enqueued because the queue is full are dropped and passed to
+// 'drop' if it is not nil. A queue with the Block policy (SyncQ,
+// SPSCQ) is waited on until it has room or the context is done; an
+// element that is still pending then is dropped. FromChan returns
+// the number of dropped elements along with the context error if the
+// context is done. Callers typically run FromChan in its own
+// go-routine.
+func FromChan[T any](ctx context.Context, ch <-chan T, q Enqueuer[T], drop func(T)) (int, error) {
+	enq := func(x T) error {
+		if !q.Enq(x) {
+			return ErrFull
+		}
+		return nil
+	}
+
+	if bq, ok := q.(blockingEnqueuer[T]); ok && bq.blocks() {
+		enq = func(x T) error {
+			return bq.EnqWait(ctx, x)
+		}
+	}
+
+	var n int
+	for {
+		select {
+		case x, ok := <-ch:
+			if !ok {
+				return n, nil
+			}
+
+			if err := enq(x); err != nil {
+				n++
+				if drop != nil {
+					drop(x)
+				}
+				if err := ctx.Err(); err != nil {
+					return n, err
+				}
+			}
+
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+}
+
+// ToChan returns a channel that delivers the elements dequeued from
+// 'q' in FIFO order; the channel is closed when the context is done.
+// An element that was dequeued but couldn't be delivered before the
+// context is done is passed to 'drop' if it is not nil. Queues that
+// support blocking dequeues (e.g., SyncQ) are waited on; other queues
+// are polled with an exponential backoff. An SPSCQ is only waited on
+// if its wait strategy is SpinPark or TimedBackoff; the others would
+// keep a CPU busy while the queue is idle.
+func ToChan[T any](ctx context.Context, q Dequeuer[T], drop func(T)) <-chan T {
+	ch := make(chan T)
+
+	deq := func() (T, bool) {
+		var b backoff
+
+		for {
+			if x, ok := q.Deq(); ok {
+				return x, true
+			}
+			if !b.wait(ctx) {
+				var z T
+				return z, false
+			}
+		}
+	}
+
+	if wq, ok := q.(waitDequeuer[T]); ok && waitIdles(q) {
+		deq = func() (T, bool) {
+			x, err := wq.DeqWait(ctx)
+			return x, err == nil
+		}
+	}
+
+	go func() {
+		defer close(ch)
+
+		for {
+			x, ok := deq()
+			if !ok {
+				return
+			}
+
+			select {
+			case ch <- x:
+			case <-ctx.Done():
+				if drop != nil {
+					drop(x)
+				}
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// waitIdles returns true if a blocking dequeue on 'q' gives up the CPU
+func waitIdles(q any) bool {
+	if iq, ok := q.(idler); ok {
+		return iq.idles()
+	}
+	return true
+}
+
+// backoff sleeps for exponentially increasing durations
+type backoff struct {
+	d time.Duration
+}
+
+const (
+	minBackoff = 10 * time.Microsecond
+	maxBackoff = 2 * time.Millisecond
+)
+
+// next returns the next backoff interval
+func (b *backoff) next() time.Duration {
+	b.d = min(max(2*b.d, minBackoff), maxBackoff)
+	return b.d
+}
+
+// wait sleeps for the next backoff interval; return false if the
+// context is done.
+func (b *backoff) wait(ctx context.Context) bool {
+	t := time.NewTimer(b.next())
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,196 @@
+// chanq_test.go - tests for channel bridges
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFromChan(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewQ[int](8)
+	ch := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		ch <- i
+	}
+	close(ch)
+
+	var dropped []int
+	n, err := FromChan(context.Background(), ch, q, func(x int) {
+		dropped = append(dropped, x)
+	})
+	assert(err == nil, "fromchan: %v", err)
+	assert(n == 2, "fromchan: exp 2 drops, saw %d", n)
+	assert(len(dropped) == 2 && dropped[0] == 8, "dropped: saw %v", dropped)
+
+	for i := 0; i < 8; i++ {
+		z, ok := q.Deq()
+		assert(ok && z == i, "deq: exp %d, saw %d", i, z)
+	}
+
+	// cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	n, err = FromChan(ctx, make(chan int), q, nil)
+	assert(errors.Is(err, context.Canceled), "fromchan: exp cancel, saw %v", err)
+	assert(n == 0, "fromchan: exp 0 drops, saw %d", n)
+}
+
+func TestFromChanBlock(t *testing.T) {
+	queues := map[string]Enqueuer[int]{
+		"SyncQ": NewSyncQ(1, WithPolicy[int](Block)),
+		"SPSCQ": NewSPSCQ(1, WithPolicy[int](Block), WithWaitStrategy[int](NewSpinPark(0))),
+	}
+
+	for nm, q := range queues {
+		t.Run(nm, func(t *testing.T) {
+			assert := newAsserter(t)
+
+			// a full queue with the Block policy must not keep
+			// FromChan from seeing the cancellation
+			assert(q.Enq(1), "enq failed")
+			ch := make(chan int, 1)
+			ch <- 2
+
+			var dropped []int
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			done := make(chan struct{})
+			var n int
+			var err error
+			go func() {
+				n, err = FromChan(ctx, ch, q, func(x int) {
+					dropped = append(dropped, x)
+				})
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("fromchan: didn't return on cancellation")
+			}
+			assert(errors.Is(err, context.DeadlineExceeded), "fromchan: exp timeout, saw %v", err)
+			assert(n == 1, "fromchan: exp 1 drop, saw %d", n)
+			assert(len(dropped) == 1 && dropped[0] == 2, "dropped: saw %v", dropped)
+		})
+	}
+}
+
+func testToChan(t *testing.T, q interface {
+	Enqueuer[int]
+	Dequeuer[int]
+}) {
+	assert := newAsserter(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := ToChan(ctx, q, nil)
+
+	const n = 100
+	go func() {
+		for i := 0; i < n; {
+			if q.Enq(i) {
+				i++
+			} else {
+				time.Sleep(time.Microsecond)
+			}
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		select {
+		case z := <-out:
+			assert(z == i, "tochan: exp %d, saw %d", i, z)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tochan: timed out waiting for %d", i)
+		}
+	}
+
+	// the channel must be closed on cancellation
+	cancel()
+	select {
+	case _, ok := <-out:
+		assert(!ok, "tochan: expected closed channel")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tochan: channel not closed")
+	}
+}
+
+func TestToChan(t *testing.T) {
+	t.Run("SyncQ", func(t *testing.T) {
+		testToChan(t, NewSyncQ[int](8))
+	})
+	t.Run("SPSCQ", func(t *testing.T) {
+		testToChan(t, NewSPSCQ[int](8))
+	})
+	t.Run("MPMCQ", func(t *testing.T) {
+		testToChan(t, NewMPMCQ[int](8))
+	})
+}
+
+func TestToChanDrop(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSyncQ[int](4)
+	q.Enq(42)
+
+	dropped := make(chan int, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := ToChan(ctx, q, func(x int) {
+		dropped <- x
+	})
+
+	// nobody reads 'out'; the dequeued element must be reported
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case z := <-dropped:
+		assert(z == 42, "drop: exp 42, saw %d", z)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("drop: timed out")
+	}
+
+	_, ok := <-out
+	assert(!ok, "tochan: expected closed channel")
+}
+
+func TestToChanIdle(t *testing.T) {
+	for nm, mk := range testStrategies() {
+		t.Run(nm, func(t *testing.T) {
+			assert := newAsserter(t)
+
+			ws := mk()
+			q := NewSPSCQ(8, WithWaitStrategy[int](ws))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			out := ToChan(ctx, q, nil)
+			time.Sleep(50 * time.Millisecond)
+
+			// an idle queue must not keep a spinning waiter busy
+			if !idles(ws) {
+				assert(ws.Parks() == 0, "idle queue: exp polling, saw %d parks", ws.Parks())
+			}
+			assert(q.sig == signals(ws), "signal: exp %v, saw %v", signals(ws), q.sig)
+
+			q.Enq(42)
+			select {
+			case z := <-out:
+				assert(z == 42, "tochan: exp 42, saw %d", z)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("tochan: timed out")
+			}
+		})
+	}
+}
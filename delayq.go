@@ -0,0 +1,233 @@
+// delayq.go - Delay queue that releases elements after their deadline
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a DelayQ; tests can supply their
+// own implementation to avoid sleeping.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// AfterFunc calls 'f' in its own go-routine after duration 'd'
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock
+type Timer interface {
+	// Stop prevents the timer from firing; it returns false if the
+	// timer has already fired or been stopped.
+	Stop() bool
+}
+
+// sysClock is the Clock backed by package time
+type sysClock struct{}
+
+func (sysClock) Now() time.Time {
+	return time.Now()
+}
+
+func (sysClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// DelayQ[T] is a thread-safe, unbounded queue whose elements become
+// available for dequeuing only after their deadline has passed.
+// Elements are dequeued in deadline order; elements with the same
+// deadline are dequeued in FIFO order. The queue uses a single timer
+// for the earliest deadline.
+type DelayQ[T any] struct {
+	sync.Mutex
+
+	pq  PQ[delayItem[T]]
+	seq uint64
+	clk Clock
+
+	// timer armed for the earliest deadline; 'gen' identifies the
+	// current timer so that stale timers are ignored
+	tm  Timer
+	at  time.Time
+	gen uint64
+
+	ready waitq
+}
+
+type delayItem[T any] struct {
+	v   T
+	at  time.Time
+	seq uint64
+}
+
+// Make a new delay queue that uses the system clock
+func NewDelayQ[T any]() *DelayQ[T] {
+	return NewDelayQWithClock[T](sysClock{})
+}
+
+// Make a new delay queue that uses the clock 'clk'
+func NewDelayQWithClock[T any](clk Clock) *DelayQ[T] {
+	q := &DelayQ[T]{
+		clk: clk,
+	}
+
+	q.pq.init(0, func(a, b delayItem[T]) bool {
+		if a.at.Equal(b.at) {
+			return a.seq < b.seq
+		}
+		return a.at.Before(b.at)
+	})
+	return q
+}
+
+// Enq inserts a new element that becomes available at time 'at'
+func (q *DelayQ[T]) Enq(x T, at time.Time) {
+	q.Lock()
+	q.seq++
+	it := q.pq.Push(delayItem[T]{x, at, q.seq})
+
+	// a new earliest deadline: let the waiters re-arm the timer
+	if it.idx == 0 {
+		q.ready.wakeup()
+	}
+	q.Unlock()
+}
+
+// EnqAfter inserts a new element that becomes available after
+// duration 'd'
+func (q *DelayQ[T]) EnqAfter(x T, d time.Duration) {
+	q.Enq(x, q.clk.Now().Add(d))
+}
+
+// Deq dequeues the element with the earliest deadline if that
+// deadline has passed. The bool retval is false if no element is due.
+func (q *DelayQ[T]) Deq() (T, bool) {
+	q.Lock()
+	x, ok, _ := q.deq()
+	q.Unlock()
+	return x, ok
+}
+
+// DeqWait dequeues the element with the earliest deadline; the
+// caller is blocked until that deadline passes or the context is
+// cancelled. It returns the context error if the context is done
+// before an element is due.
+func (q *DelayQ[T]) DeqWait(ctx context.Context) (T, error) {
+	q.Lock()
+	for {
+		x, ok, at := q.deq()
+		if ok {
+			q.Unlock()
+			return x, nil
+		}
+
+		if !at.IsZero() {
+			q.arm(at)
+		}
+
+		ch := q.ready.wait()
+		q.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return x, ctx.Err()
+		}
+		q.Lock()
+	}
+}
+
+// Len returns the number of elements in the queue, including ones
+// that are not yet due.
+func (q *DelayQ[T]) Len() int {
+	q.Lock()
+	n := q.pq.Len()
+	q.Unlock()
+	return n
+}
+
+// IsEmpty returns true if the queue is empty
+func (q *DelayQ[T]) IsEmpty() bool {
+	return q.Len() == 0
+}
+
+// Flush empties the queue and stops the timer
+func (q *DelayQ[T]) Flush() {
+	q.Lock()
+	q.pq.Flush()
+	q.stop()
+	q.Unlock()
+}
+
+// String prints a string representation of the queue
+func (q *DelayQ[T]) String() string {
+	q.Lock()
+	defer q.Unlock()
+
+	if it, ok := q.pq.Peek(); ok {
+		return fmt.Sprintf("<DelayQ %T len=%d next=%s>", q, q.pq.Len(),
+			it.at.Format(time.RFC3339Nano))
+	}
+	return fmt.Sprintf("<DelayQ %T [EMPTY] len=0>", q)
+}
+
+// deq pops the earliest element if it is due. If it isn't due, deq
+// returns its deadline; the deadline is zero if the queue is empty.
+// Must be called with the lock held.
+func (q *DelayQ[T]) deq() (T, bool, time.Time) {
+	var z T
+
+	it, ok := q.pq.Peek()
+	if !ok {
+		return z, false, time.Time{}
+	}
+
+	if it.at.After(q.clk.Now()) {
+		return z, false, it.at
+	}
+
+	q.pq.Pop()
+	return it.v, true, time.Time{}
+}
+
+// arm makes sure the timer fires at 'at'. Must be called with the
+// lock held.
+func (q *DelayQ[T]) arm(at time.Time) {
+	if q.tm != nil && q.at.Equal(at) {
+		return
+	}
+
+	q.stop()
+	q.gen++
+	gen := q.gen
+	q.at = at
+	q.tm = q.clk.AfterFunc(at.Sub(q.clk.Now()), func() {
+		q.Lock()
+		if q.gen == gen {
+			q.tm = nil
+			q.ready.wakeup()
+		}
+		q.Unlock()
+	})
+}
+
+// stop stops the current timer. Must be called with the lock held.
+func (q *DelayQ[T]) stop() {
+	if q.tm != nil {
+		q.tm.Stop()
+		q.tm = nil
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,182 @@
+// delayq_test.go - tests for delay queues
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c     *fakeClock
+	at    time.Time
+	f     func()
+	armed bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{c: c, at: c.now.Add(d), f: f, armed: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward and fires the timers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+
+	var due []*fakeTimer
+	var rest []*fakeTimer
+	for _, t := range c.timers {
+		switch {
+		case !t.armed:
+		case t.at.After(c.now):
+			rest = append(rest, t)
+		default:
+			t.armed = false
+			due = append(due, t)
+		}
+	}
+	c.timers = rest
+	c.Unlock()
+
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.Lock()
+	defer t.c.Unlock()
+
+	r := t.armed
+	t.armed = false
+	return r
+}
+
+func TestDelayQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	clk := newFakeClock()
+	q := NewDelayQWithClock[int](clk)
+
+	q.EnqAfter(20, 20*time.Second)
+	q.EnqAfter(10, 10*time.Second)
+	q.EnqAfter(30, 30*time.Second)
+	q.EnqAfter(11, 10*time.Second)
+	assert(q.Len() == 4, "len: exp 4, saw %d", q.Len())
+
+	_, ok := q.Deq()
+	assert(!ok, "deq: nothing should be due")
+
+	clk.Advance(10 * time.Second)
+	z, ok := q.Deq()
+	assert(ok && z == 10, "deq: exp 10, saw %d", z)
+	z, ok = q.Deq()
+	assert(ok && z == 11, "deq: exp 11, saw %d", z)
+	_, ok = q.Deq()
+	assert(!ok, "deq: nothing should be due")
+
+	clk.Advance(time.Hour)
+	z, ok = q.Deq()
+	assert(ok && z == 20, "deq: exp 20, saw %d", z)
+	z, ok = q.Deq()
+	assert(ok && z == 30, "deq: exp 30, saw %d", z)
+	assert(q.IsEmpty(), "expected q to be empty")
+}
+
+func TestDelayQWait(t *testing.T) {
+	assert := newAsserter(t)
+
+	clk := newFakeClock()
+	q := NewDelayQWithClock[int](clk)
+
+	res := make(chan int)
+	go func() {
+		for i := 0; i < 3; i++ {
+			z, err := q.DeqWait(context.Background())
+			if err != nil {
+				t.Errorf("deq: %s", err)
+			}
+			res <- z
+		}
+	}()
+
+	expect := func(exp int) {
+		select {
+		case z := <-res:
+			assert(z == exp, "deq: exp %d, saw %d", exp, z)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %d", exp)
+		}
+	}
+
+	q.EnqAfter(20, 20*time.Second)
+
+	// a new earliest deadline must re-arm the timer
+	q.EnqAfter(10, 10*time.Second)
+	q.EnqAfter(30, 30*time.Second)
+
+	// give the consumer time to block and arm the timer; nothing
+	// must come out before the clock moves
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case z := <-res:
+		t.Fatalf("deq: unexpected element %d", z)
+	default:
+	}
+
+	clk.Advance(10 * time.Second)
+	expect(10)
+
+	clk.Advance(10 * time.Second)
+	expect(20)
+
+	clk.Advance(10 * time.Second)
+	expect(30)
+}
+
+func TestDelayQCancel(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewDelayQ[int]()
+	q.EnqAfter(1, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := q.DeqWait(ctx)
+	assert(errors.Is(err, context.DeadlineExceeded), "deq: exp timeout, saw %v", err)
+
+	// real clock
+	q.Flush()
+	start := time.Now()
+	q.EnqAfter(2, 20*time.Millisecond)
+	z, err := q.DeqWait(context.Background())
+	assert(err == nil, "deq: %v", err)
+	assert(z == 2, "deq: exp 2, saw %d", z)
+	assert(time.Since(start) >= 20*time.Millisecond, "deq: returned too early")
+}
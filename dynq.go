@@ -0,0 +1,154 @@
+// dynq.go - Growable circular queue
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"iter"
+)
+
+// DynQ[T] is a generic queue that doubles its (power-of-2) size
+// instead of failing Enq when it is full. It can optionally be
+// capped at a maximum size and shrink when utilisation drops.
+// DynQ is not thread-safe.
+type DynQ[T any] struct {
+	Q[T]
+
+	min    uint64 // initial number of slots
+	max    uint64 // max number of slots; 0 => unbounded
+	shrink bool
+}
+
+// DynQOption is a functional option for NewDynQ
+type DynQOption func(o *dynqOpts)
+
+type dynqOpts struct {
+	max    int
+	shrink bool
+}
+
+// WithMaxSize caps the queue to hold (at least) 'n' elements; once
+// the queue reaches this size, Enq will return false when the queue
+// is full.
+func WithMaxSize(n int) DynQOption {
+	return func(o *dynqOpts) {
+		o.max = n
+	}
+}
+
+// WithShrink makes the queue halve its size when it is less than a
+// quarter full; the queue never shrinks below its initial size.
+func WithShrink() DynQOption {
+	return func(o *dynqOpts) {
+		o.shrink = true
+	}
+}
+
+// Make a new growable queue with initial room for (at least) 'n'
+// slots. If 'n' is NOT a power-of-2, this function will pick the next
+// closest power-of-2.
+func NewDynQ[T any](n int, opts ...DynQOption) *DynQ[T] {
+	var o dynqOpts
+
+	for _, fp := range opts {
+		fp(&o)
+	}
+
+	q := &DynQ[T]{
+		shrink: o.shrink,
+	}
+
+	q.init(n)
+	q.min = uint64(len(q.q))
+	if o.max > 0 {
+		q.max = max(q.min, nextpow2(uint64(o.max))) //#nosec G115 -- 64 bit platforms
+	}
+	return q
+}
+
+// Enq inserts a new element, growing the queue if needed; return
+// false if the queue is full and has reached its maximum size.
+func (q *DynQ[T]) Enq(x T) bool {
+	q.grow()
+	return q.Q.Enq(x)
+}
+
+// PushFront inserts a new element at the head of the queue, growing
+// the queue if needed; return false if the queue is full and has
+// reached its maximum size.
+func (q *DynQ[T]) PushFront(x T) bool {
+	q.grow()
+	return q.Q.PushFront(x)
+}
+
+// Deq removes the oldest element; return false if queue empty
+func (q *DynQ[T]) Deq() (T, bool) {
+	x, ok := q.Q.Deq()
+	if ok {
+		q.shrinkMaybe()
+	}
+	return x, ok
+}
+
+// PopBack removes the newest element; return false if queue empty
+func (q *DynQ[T]) PopBack() (T, bool) {
+	x, ok := q.Q.PopBack()
+	if ok {
+		q.shrinkMaybe()
+	}
+	return x, ok
+}
+
+// Flush empties the queue; if shrinking is enabled, the queue is
+// also restored to its initial size.
+func (q *DynQ[T]) Flush() {
+	q.Q.Flush()
+	if q.shrink && uint64(len(q.q)) > q.min {
+		q.resize(q.min)
+	}
+}
+
+// Drain returns an iterator that dequeues each element of the queue
+// from the oldest to the newest, shrinking the queue as needed.
+func (q *DynQ[T]) Drain() iter.Seq[T] {
+	return drain(q.Deq)
+}
+
+// grow doubles the queue if it is full and hasn't reached its
+// maximum size.
+func (q *DynQ[T]) grow() {
+	if !q.Q.IsFull() {
+		return
+	}
+
+	z := 2 * uint64(len(q.q))
+	if q.max == 0 || z <= q.max {
+		q.resize(z)
+	}
+}
+
+// shrinkMaybe halves the queue if shrinking is enabled and the queue
+// is less than a quarter full.
+func (q *DynQ[T]) shrinkMaybe() {
+	if !q.shrink {
+		return
+	}
+
+	z := uint64(len(q.q))
+	if z > q.min && uint64(q.Q.Len()) < z/4 { //#nosec G115 -- Len() is never negative
+		q.resize(z / 2)
+	}
+}
+
+// String dumps the queue in human readable form
+func (q *DynQ[T]) String() string {
+	return q.repr("DynQ")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,109 @@
+// dynq_test.go - tests for growable queues
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestDynQGrow(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewDynQ[int](3)
+	assert(q.Size() == 4, "size: exp 4, saw %d", q.Size())
+
+	// leave some elements behind so that the contents wrap around
+	for i := 0; i < 3; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	for i := 0; i < 2; i++ {
+		z, ok := q.Deq()
+		assert(ok, "deq-%d failed", i)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+
+	for i := 3; i < 100; i++ {
+		assert(q.Enq(i), "enq-%d failed\n%s", i, q)
+	}
+
+	assert(q.Len() == 98, "len: exp 98, saw %d", q.Len())
+	assert(q.Size() == 128, "size: exp 128, saw %d", q.Size())
+
+	for i := 2; i < 100; i++ {
+		z, ok := q.Deq()
+		assert(ok, "deq-%d failed", i)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+	assert(q.IsEmpty(), "expected q to be empty\n%s", q)
+}
+
+func TestDynQMax(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewDynQ[int](2, WithMaxSize(10))
+	assert(q.Size() == 2, "size: exp 2, saw %d", q.Size())
+
+	var n int
+	for q.Enq(n) {
+		n++
+	}
+
+	assert(n == 16, "exp 16 elements, saw %d", n)
+	assert(q.Size() == 16, "size: exp 16, saw %d", q.Size())
+	assert(q.IsFull(), "expected q to be full\n%s", q)
+
+	for i := 0; i < n; i++ {
+		z, ok := q.Deq()
+		assert(ok, "deq-%d failed", i)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+}
+
+func TestDynQShrink(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewDynQ[int](8, WithShrink())
+	assert(q.Size() == 8, "size: exp 8, saw %d", q.Size())
+
+	for i := 0; i < 200; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	assert(q.Size() == 256, "size: exp 256, saw %d", q.Size())
+
+	for i := 0; i < 195; i++ {
+		z, ok := q.Deq()
+		assert(ok, "deq-%d failed", i)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+	assert(q.Size() < 64, "size: exp shrunk queue, saw %d", q.Size())
+	assert(q.Len() == 5, "len: exp 5, saw %d", q.Len())
+
+	for i := 195; i < 200; i++ {
+		z, ok := q.Deq()
+		assert(ok, "deq-%d failed", i)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+	assert(q.Size() == 8, "size: exp 8, saw %d", q.Size())
+
+	for i := 0; i < 100; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	q.Flush()
+	assert(q.IsEmpty(), "expected q to be empty")
+	assert(q.Size() == 8, "size: exp 8, saw %d", q.Size())
+}
+
+func TestDynQDeque(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewDynQ[int](2, WithShrink())
+	for i := 0; i < 50; i++ {
+		assert(q.PushFront(i), "pushfront-%d failed", i)
+	}
+	for i := 0; i < 50; i++ {
+		z, ok := q.PopBack()
+		assert(ok, "pop-back-%d failed", i)
+		assert(z == i, "pop-back: exp %d, saw %d", i, z)
+	}
+	assert(q.Size() == 2, "size: exp 2, saw %d", q.Size())
+}
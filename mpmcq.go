@@ -0,0 +1,183 @@
+// mpmcq.go - Fixed size lock-free MPMC circular queue
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// Notes:
+//   - this is Dmitry Vyukov's bounded MPMC queue
+//   - rd and wr are free running counters; slot index is 'ctr & mask'
+//   - each slot has a sequence number that tells producers and
+//     consumers whose turn it is:
+//     seq == pos:   slot is free for the producer claiming 'pos'
+//     seq == pos+1: slot is filled for the consumer claiming 'pos'
+//   - a consumer that finds a slot claimed by a producer but not yet
+//     filled waits for it; returning "empty" would be wrong since
+//     the producer has already made the queue look fuller to the
+//     other producers. Likewise, a producer waits for a slot that a
+//     consumer claimed but hasn't released yet.
+
+// MPMCQ[T] is a generic & bounded lock-free multi-producer,
+// multi-consumer queue. This queue always has a power-of-2 size
+// and a queue with capacity 'N' will store N elements.
+type MPMCQ[T any] struct {
+	wr atomic.Uint64
+	_  [7]uint64 // cache-line pad
+
+	rd atomic.Uint64
+	_  [7]uint64 // cache-line pad
+
+	mask uint64
+	q    []mpmcSlot[T]
+}
+
+type mpmcSlot[T any] struct {
+	seq atomic.Uint64
+	v   T
+}
+
+// Make a new MPMC-Q to hold at-least 'n' elements. If 'n'
+// is not a power-of-2, this function will pick the next
+// closest power-of-2. The queue has at least 2 slots.
+func NewMPMCQ[T any](n int) *MPMCQ[T] {
+	q := &MPMCQ[T]{}
+
+	// with a single slot, a filled slot (seq == pos+1) looks free to
+	// the producer of 'pos+1'.
+	z := nextpow2(uint64(max(n, 2))) //#nosec G115 -- 64-bit platforms no overflow
+
+	q.mask = z - 1
+	q.q = make([]mpmcSlot[T], z)
+	for i := range q.q {
+		q.q[i].seq.Store(uint64(i)) //#nosec G115 -- 64-bit platforms
+	}
+	return q
+}
+
+// Enq enqueues a new element. Returns true on success
+// and false when Q is full.
+func (q *MPMCQ[T]) Enq(x T) bool {
+	pos := q.wr.Load()
+	for {
+		s := &q.q[pos&q.mask]
+		seq := s.seq.Load()
+
+		switch d := int64(seq - pos); { //#nosec G115 -- wraparound is intended
+		case d == 0:
+			if q.wr.CompareAndSwap(pos, pos+1) {
+				s.v = x
+				s.seq.Store(pos + 1)
+				return true
+			}
+			pos = q.wr.Load()
+		case d < 0:
+			if int64(pos-q.rd.Load()) >= int64(len(q.q)) { //#nosec G115 -- wraparound is intended
+				return false
+			}
+
+			// a consumer claimed the slot but hasn't released it yet
+			runtime.Gosched()
+			pos = q.wr.Load()
+		default:
+			// another producer got here first
+			pos = q.wr.Load()
+		}
+	}
+}
+
+// Deq dequeues an element from the queue. Returns false
+// if the queue is empty, true otherwise.
+func (q *MPMCQ[T]) Deq() (T, bool) {
+	var z T
+
+	pos := q.rd.Load()
+	for {
+		s := &q.q[pos&q.mask]
+		seq := s.seq.Load()
+
+		switch d := int64(seq - (pos + 1)); { //#nosec G115 -- wraparound is intended
+		case d == 0:
+			if q.rd.CompareAndSwap(pos, pos+1) {
+				x := s.v
+				s.v = z
+				s.seq.Store(pos + q.mask + 1)
+				return x, true
+			}
+			pos = q.rd.Load()
+		case d < 0:
+			if q.wr.Load() == pos {
+				return z, false
+			}
+
+			// a producer claimed 'pos' but hasn't filled it yet
+			runtime.Gosched()
+			pos = q.rd.Load()
+		default:
+			// another consumer got here first
+			pos = q.rd.Load()
+		}
+	}
+}
+
+// Flush empties the queue by dequeuing all its elements. It is safe
+// to call concurrently with Enq and Deq; elements enqueued during the
+// flush may remain.
+func (q *MPMCQ[T]) Flush() {
+	for {
+		if _, ok := q.Deq(); !ok {
+			return
+		}
+	}
+}
+
+// IsEmpty returns true if the queue is empty
+func (q *MPMCQ[T]) IsEmpty() bool {
+	return q.Len() == 0
+}
+
+// IsFull returns true if the queue is full
+func (q *MPMCQ[T]) IsFull() bool {
+	return q.Len() == len(q.q)
+}
+
+// Len returns the number of elements in the queue. In the presence
+// of concurrent producers and consumers, this is only a snapshot.
+func (q *MPMCQ[T]) Len() int {
+	rd, wr := q.load()
+	return int(wr - rd) //#nosec G115 -- load() bounds this by the size
+}
+
+// Size returns the capacity of the queue
+func (q *MPMCQ[T]) Size() int {
+	return len(q.q)
+}
+
+// String returns a human readable description of the queue
+func (q *MPMCQ[T]) String() string {
+	rd, wr := q.load()
+	suff := qrepr(rd, wr, q.mask+1)
+
+	return fmt.Sprintf("<MPMCQ %T %s>", q, suff)
+}
+
+// load returns a consistent looking snapshot of the rd, wr counters
+func (q *MPMCQ[T]) load() (uint64, uint64) {
+	// read 'rd' first so that 'wr' is never behind it
+	rd := q.rd.Load()
+	wr := q.wr.Load()
+	if n := wr - rd; n > q.mask+1 {
+		wr = rd + q.mask + 1
+	}
+	return rd, wr
+}
@@ -0,0 +1,159 @@
+// mpmc queue test
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMPMCFunctionality(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewMPMCQ[int](3)
+	assert(q.Size() == 4, "size: exp 4, saw %d", q.Size())
+	assert(q.IsEmpty(), "expected q to be empty")
+
+	for i := 0; i < q.Size(); i++ {
+		ok := q.Enq(i * 100)
+		assert(ok, "can't enq %d", i*100)
+	}
+
+	assert(q.IsFull(), "expected q to be full\n%s", q)
+	assert(q.Len() == 4, "len: exp 4, saw %d", q.Len())
+
+	ok := q.Enq(400)
+	assert(!ok, "expected q full\n%s", q)
+
+	for i := 0; i < q.Size(); i++ {
+		z, ok := q.Deq()
+		assert(ok, "can't deq %d", i*100)
+		assert(z == i*100, "exp %d, saw %d", i*100, z)
+	}
+
+	_, ok = q.Deq()
+	assert(!ok, "expected q empty\n%s", q)
+	assert(q.IsEmpty(), "expected q to be empty")
+}
+
+func TestMPMCWrapAround(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewMPMCQ[int](2)
+	for i := 0; i < 100; i++ {
+		ok := q.Enq(i)
+		assert(ok, "failed to enq at cycle %d", i)
+		ok = q.Enq(i + 1000)
+		assert(ok, "failed to enq at cycle %d", i)
+
+		v, ok := q.Deq()
+		assert(ok, "failed to deq at cycle %d", i)
+		assert(v == i, "cycle %d: exp %d, got %d", i, i, v)
+		v, ok = q.Deq()
+		assert(ok, "failed to deq at cycle %d", i)
+		assert(v == i+1000, "cycle %d: exp %d, got %d", i, i+1000, v)
+	}
+}
+
+func TestMPMCSmall(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a one slot queue must not overwrite an unconsumed element
+	q := NewMPMCQ[int](1)
+	z := q.Size()
+	for i := 0; i < z; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	assert(!q.Enq(z), "enq on full q\n%s", q)
+
+	for i := 0; i < z; i++ {
+		v, ok := q.Deq()
+		assert(ok && v == i, "deq: exp %d, saw %d", i, v)
+	}
+	_, ok := q.Deq()
+	assert(!ok, "expected q empty\n%s", q)
+}
+
+// Every element enqueued by N producers must be dequeued exactly once
+// by M consumers; and each consumer must see a producer's elements
+// in the order they were enqueued.
+func TestMPMCConcurrency(t *testing.T) {
+	const (
+		nprod = 4
+		ncons = 4
+		iters = 10_000
+	)
+
+	assert := newAsserter(t)
+	q := NewMPMCQ[uint64](64)
+
+	var wg sync.WaitGroup
+
+	wg.Add(nprod)
+	for p := uint64(0); p < nprod; p++ {
+		go func(p uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < iters; {
+				if !q.Enq(p<<32 | i) {
+					runtime.Gosched()
+					continue
+				}
+				i++
+			}
+		}(p)
+	}
+
+	seen := make([][]uint64, ncons)
+	var done sync.WaitGroup
+	var total atomic.Int64
+
+	done.Add(ncons)
+	for c := 0; c < ncons; c++ {
+		go func(c int) {
+			defer done.Done()
+
+			last := make([]int64, nprod)
+			for i := range last {
+				last[i] = -1
+			}
+
+			for total.Load() < nprod*iters {
+				v, ok := q.Deq()
+				if !ok {
+					runtime.Gosched()
+					continue
+				}
+
+				p, i := v>>32, int64(v&0xffffffff) //#nosec G115 -- test
+				if i <= last[p] {
+					t.Errorf("consumer %d: producer %d out of order: %d after %d", c, p, i, last[p])
+				}
+				last[p] = i
+				seen[c] = append(seen[c], v)
+				total.Add(1)
+			}
+		}(c)
+	}
+
+	wg.Wait()
+	done.Wait()
+
+	all := make(map[uint64]bool, nprod*iters)
+	for _, v := range seen {
+		for _, x := range v {
+			assert(!all[x], "duplicate element %#x", x)
+			all[x] = true
+		}
+	}
+	assert(len(all) == nprod*iters, "exp %d elements, saw %d", nprod*iters, len(all))
+	assert(q.IsEmpty(), "expected q to be empty\n%s", q)
+}
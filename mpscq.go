@@ -0,0 +1,157 @@
+// mpscq.go - Fixed size lock-free MPSC circular queue
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// Notes:
+//   - rd and wr are free running counters; slot index is 'ctr & mask'
+//   - producers claim a slot by CAS'ing wr forward; the claimed slot
+//     is published by storing 'pos+1' in the slot's sequence number.
+//   - the lone consumer owns rd and caches wr just like SPSCQ; it
+//     waits for a claimed but not yet published slot since the queue
+//     isn't empty.
+
+// MPSCQ[T] is a generic & bounded lock-free multi-producer,
+// single-consumer queue. This queue always has a power-of-2 size
+// and a queue with capacity 'N' will store N elements.
+type MPSCQ[T any] struct {
+	rd atomic.Uint64
+	_  [7]uint64 // cache-line pad
+
+	wr atomic.Uint64
+	_  [7]uint64 // cache-line pad
+
+	wrc uint64    // write-index cached by the consumer
+	_   [7]uint64 // cache-line pad
+
+	mask uint64
+	q    []mpmcSlot[T]
+}
+
+// Make a new MPSC-Q to hold at-least 'n' elements. If 'n'
+// is not a power-of-2, this function will pick the next
+// closest power-of-2.
+func NewMPSCQ[T any](n int) *MPSCQ[T] {
+	q := &MPSCQ[T]{}
+	z := nextpow2(uint64(n)) //#nosec G115 -- 64-bit platforms no overflow
+
+	q.mask = z - 1
+	q.q = make([]mpmcSlot[T], z)
+	return q
+}
+
+// Enq enqueues a new element. Returns true on success
+// and false when Q is full. Enq is safe to call from multiple
+// go-routines.
+func (q *MPSCQ[T]) Enq(x T) bool {
+	for {
+		wr := q.wr.Load()
+		rd := q.rd.Load()
+
+		// 'wr' may be stale: other producers and the consumer can
+		// move both counters past it before 'rd' is read. The queue
+		// is only full if 'wr' didn't move while we read 'rd'.
+		if int64(wr-rd) >= int64(len(q.q)) { //#nosec G115 -- wraparound is intended
+			if q.wr.Load() == wr {
+				return false
+			}
+			continue
+		}
+
+		if q.wr.CompareAndSwap(wr, wr+1) {
+			s := &q.q[wr&q.mask]
+			s.v = x
+			s.seq.Store(wr + 1)
+			return true
+		}
+	}
+}
+
+// Deq dequeues an element from the queue. Returns false
+// if the queue is empty, true otherwise. Deq must only be called
+// from a single consumer go-routine.
+func (q *MPSCQ[T]) Deq() (T, bool) {
+	var z T
+
+	rd := q.rd.Load()
+	if rd == q.wrc {
+		if q.wrc = q.wr.Load(); rd == q.wrc {
+			return z, false
+		}
+	}
+
+	s := &q.q[rd&q.mask]
+	for s.seq.Load() != rd+1 {
+		// producer hasn't finished writing yet
+		runtime.Gosched()
+	}
+
+	x := s.v
+	s.v = z
+	q.rd.Store(rd + 1)
+	return x, true
+}
+
+// Flush empties the queue by dequeuing all its elements. It must only
+// be called by the consumer; elements enqueued during the flush may
+// remain.
+func (q *MPSCQ[T]) Flush() {
+	for {
+		if _, ok := q.Deq(); !ok {
+			return
+		}
+	}
+}
+
+// IsEmpty returns true if the queue is empty
+func (q *MPSCQ[T]) IsEmpty() bool {
+	return q.Len() == 0
+}
+
+// IsFull returns true if the queue is full
+func (q *MPSCQ[T]) IsFull() bool {
+	return q.Len() == len(q.q)
+}
+
+// Len returns the number of elements in the queue. In the presence
+// of concurrent producers and consumers, this is only a snapshot.
+func (q *MPSCQ[T]) Len() int {
+	rd, wr := q.load()
+	return int(wr - rd) //#nosec G115 -- load() bounds this by the size
+}
+
+// Size returns the capacity of the queue
+func (q *MPSCQ[T]) Size() int {
+	return len(q.q)
+}
+
+// String returns a human readable description of the queue
+func (q *MPSCQ[T]) String() string {
+	rd, wr := q.load()
+	suff := qrepr(rd, wr, q.mask+1)
+
+	return fmt.Sprintf("<MPSCQ %T %s>", q, suff)
+}
+
+// load returns a consistent looking snapshot of the rd, wr counters
+func (q *MPSCQ[T]) load() (uint64, uint64) {
+	// read 'rd' first so that 'wr' is never behind it
+	rd := q.rd.Load()
+	wr := q.wr.Load()
+	if n := wr - rd; n > q.mask+1 {
+		wr = rd + q.mask + 1
+	}
+	return rd, wr
+}
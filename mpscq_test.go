@@ -0,0 +1,182 @@
+// mpsc queue test
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMPSCFunctionality(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewMPSCQ[int](3)
+	assert(q.Size() == 4, "size: exp 4, saw %d", q.Size())
+	assert(q.IsEmpty(), "expected q to be empty")
+
+	for i := 0; i < q.Size(); i++ {
+		ok := q.Enq((i + 1) * 100)
+		assert(ok, "can't enq %d", (i+1)*100)
+	}
+
+	assert(q.IsFull(), "expected q to be full\n%s", q)
+
+	ok := q.Enq(500)
+	assert(!ok, "expected q full\n%s", q)
+
+	for i := 0; i < q.Size(); i++ {
+		z, ok := q.Deq()
+		assert(ok, "can't deq %d", (i+1)*100)
+		assert(z == (i+1)*100, "exp %d, saw %d", (i+1)*100, z)
+	}
+
+	_, ok = q.Deq()
+	assert(!ok, "expected q empty\n%s", q)
+}
+
+func TestMPSCWrapAround(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewMPSCQ[int](2)
+	for i := 0; i < 100; i++ {
+		ok := q.Enq(i)
+		assert(ok, "failed to enq at cycle %d", i)
+
+		v, ok := q.Deq()
+		assert(ok, "failed to deq at cycle %d", i)
+		assert(v == i, "cycle %d: exp %d, got %d", i, i, v)
+	}
+}
+
+func TestMPSCZeroValue(t *testing.T) {
+	assert := newAsserter(t)
+	q := NewMPSCQ[int](16)
+
+	ok := q.Enq(0)
+	assert(ok, "failed to enq 0")
+
+	v, ok := q.Deq()
+	assert(ok, "should have received value 0, got empty")
+	assert(v == 0, "exp 0, got %d", v)
+
+	_, ok = q.Deq()
+	assert(!ok, "queue should be empty after deq 0")
+}
+
+// TestMPSCTorture runs several producers with random jitter against a
+// single consumer; the consumer verifies that each producer's elements
+// arrive exactly once and in order. Run with -race.
+func TestMPSCTorture(t *testing.T) {
+	const (
+		nprod = 4
+		iters = 10_000
+	)
+
+	q := NewMPSCQ[uint64](128)
+
+	var wg sync.WaitGroup
+	wg.Add(nprod)
+	for p := uint64(0); p < nprod; p++ {
+		go func(p uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < iters; i++ {
+				for !q.Enq(p<<32 | i) {
+					if rand.Float32() < 0.01 {
+						time.Sleep(time.Microsecond)
+					} else {
+						runtime.Gosched()
+					}
+				}
+				if rand.Float32() < 0.005 {
+					time.Sleep(time.Microsecond)
+				}
+			}
+		}(p)
+	}
+
+	var next [nprod]uint64
+	for n := 0; n < nprod*iters; {
+		v, ok := q.Deq()
+		if !ok {
+			if rand.Float32() < 0.01 {
+				time.Sleep(time.Microsecond)
+			} else {
+				runtime.Gosched()
+			}
+			continue
+		}
+
+		p, i := v>>32, v&0xffffffff
+		if i != next[p] {
+			t.Fatalf("producer %d: exp %d, got %d", p, next[p], i)
+		}
+		next[p]++
+		n++
+	}
+
+	wg.Wait()
+	if !q.IsEmpty() {
+		t.Fatalf("expected q to be empty\n%s", q)
+	}
+}
+
+// TestMPSCNoFalseFull checks that Enq never fails on a queue that
+// isn't full: the producers keep at most half the queue in flight.
+func TestMPSCNoFalseFull(t *testing.T) {
+	const (
+		nprod = 8
+		iters = 20_000
+		size  = 4096
+	)
+
+	q := NewMPSCQ[uint64](size)
+
+	var inflight atomic.Int64
+	var fails atomic.Int64
+	var wg sync.WaitGroup
+
+	wg.Add(nprod)
+	for p := uint64(0); p < nprod; p++ {
+		go func(p uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < iters; {
+				if inflight.Add(1) > size/2 {
+					inflight.Add(-1)
+					runtime.Gosched()
+					continue
+				}
+				if !q.Enq(p<<32 | i) {
+					fails.Add(1)
+					inflight.Add(-1)
+					continue
+				}
+				i++
+			}
+		}(p)
+	}
+
+	for n := 0; n < nprod*iters; {
+		if _, ok := q.Deq(); ok {
+			inflight.Add(-1)
+			n++
+		} else {
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+
+	if n := fails.Load(); n > 0 {
+		t.Fatalf("enq failed %d times on a queue that isn't full", n)
+	}
+}
@@ -0,0 +1,826 @@
+// persistq.go - Disk backed persistent queue
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notes:
+//   - the queue is a directory of append-only segment files named
+//     '<id>.seg' where 'id' is a monotonically increasing hex number.
+//   - each record is: len (4 bytes) | crc32c (4 bytes) | payload
+//   - the consumer offset (segment id, byte offset) is kept in the
+//     file 'consumer.off' with two alternating, checksummed slots; a
+//     torn write of one slot leaves the other one intact.
+//   - on open, the segments are scanned from the consumer offset and
+//     truncated at the first torn or corrupt record.
+//   - segments that are fully consumed are deleted.
+//   - an open queue holds an exclusive flock on 'consumer.off'; a
+//     second instance on the same directory would corrupt both.
+//   - a record that fails to be written or synced is truncated away.
+//   - Close stops producers and syncs the writer; consumers drain the
+//     remaining elements and the files are released once the queue
+//     is empty. Shutdown releases the files right away and leaves
+//     the remaining elements on disk.
+
+// Codec[T] serializes the elements of a PersistentQ[T]
+type Codec[T any] interface {
+	Marshal(x T) ([]byte, error)
+	Unmarshal(b []byte) (T, error)
+}
+
+// GobCodec[T] is a Codec that uses encoding/gob
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(x T) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&x); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobCodec[T]) Unmarshal(b []byte) (T, error) {
+	var x T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&x)
+	return x, err
+}
+
+// JSONCodec[T] is a Codec that uses encoding/json
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(x T) ([]byte, error) {
+	return json.Marshal(x)
+}
+
+func (JSONCodec[T]) Unmarshal(b []byte) (T, error) {
+	var x T
+	err := json.Unmarshal(b, &x)
+	return x, err
+}
+
+const (
+	pqRecHdr     = 8                // record header size
+	pqMaxRec     = 1 << 30          // largest record we'll accept
+	pqSegSize    = 64 * 1024 * 1024 // default segment size
+	pqOffFile    = "consumer.off"
+	pqOffSlot    = 32 // size of an offset slot
+	pqSegSuffix  = ".seg"
+	pqSegNameLen = 16
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrLocked is returned when opening a persistent queue that is in use
+var ErrLocked = errors.New("queue is in use")
+
+// PersistentQ[T] is a thread-safe, unbounded FIFO queue that is
+// persisted to a directory as a write-ahead log. The contents and
+// the consumer position survive process restarts and crashes.
+// Elements are serialized with a caller supplied Codec. Enq, Deq and
+// Close have the same semantics as SyncQ; since the queue is
+// unbounded, Enq only fails on errors or a closed queue.
+type PersistentQ[T any] struct {
+	sync.Mutex
+
+	dir   string
+	codec Codec[T]
+	segsz int64
+	fsync bool
+
+	segs []uint64 // segment ids in order; the last one is being written
+
+	wfd  *os.File
+	woff int64
+
+	rfd  *os.File
+	roff int64
+
+	ofd *os.File
+	gen uint64 // checkpoint generation
+
+	// consumers blocked in DeqWait()
+	notEmpty waitq
+
+	n        int // pending records
+	closed   bool
+	released bool // the files are closed
+}
+
+// PersistentQOption is a functional option for OpenPersistentQ
+type PersistentQOption func(o *persistqOpts)
+
+type persistqOpts struct {
+	segsz int64
+	fsync bool
+}
+
+// WithSegmentSize sets the size at which a new segment is started;
+// the default is 64MB.
+func WithSegmentSize(n int64) PersistentQOption {
+	return func(o *persistqOpts) {
+		o.segsz = n
+	}
+}
+
+// WithFsync makes every Enq and Deq fsync the data and the consumer
+// offset to stable storage before returning. Without it, the queue
+// survives process crashes but may lose recent updates on a power
+// failure.
+func WithFsync() PersistentQOption {
+	return func(o *persistqOpts) {
+		o.fsync = true
+	}
+}
+
+// OpenPersistentQ opens the persistent queue in directory 'dir',
+// creating it if necessary, and recovers its contents. A queue can
+// only be open once at a time; opening a queue that is in use by
+// this or another process returns ErrLocked. The queue stays in use
+// until its files are released: after a closed queue is drained or
+// after Shutdown. On platforms without flock(2), the queue is not
+// locked.
+func OpenPersistentQ[T any](dir string, codec Codec[T], opts ...PersistentQOption) (*PersistentQ[T], error) {
+	o := persistqOpts{
+		segsz: pqSegSize,
+	}
+	for _, fp := range opts {
+		fp(&o)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &PersistentQ[T]{
+		dir:   dir,
+		codec: codec,
+		segsz: o.segsz,
+		fsync: o.fsync,
+	}
+
+	if err := q.recover(); err != nil {
+		q.closeFiles()
+		return nil, fmt.Errorf("persistq: %s: %w", dir, err)
+	}
+	return q, nil
+}
+
+// Enq appends a new element to the queue; it returns false if the
+// element was not enqueued because of an error or a closed queue.
+// Use EnqErr to get the error.
+func (q *PersistentQ[T]) Enq(x T) bool {
+	return q.EnqErr(x) == nil
+}
+
+// EnqErr is like Enq but returns ErrClosed if the queue is closed and
+// the codec or I/O error if the element couldn't be written.
+func (q *PersistentQ[T]) EnqErr(x T) error {
+	b, err := q.codec.Marshal(x)
+	if err != nil {
+		return err
+	}
+	if len(b) > pqMaxRec {
+		return fmt.Errorf("persistq: record too large (%d bytes)", len(b))
+	}
+
+	rec := make([]byte, pqRecHdr+len(b))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(len(b))) //#nosec G115 -- checked above
+	binary.LittleEndian.PutUint32(rec[4:8], crc32.Checksum(b, crcTable))
+	copy(rec[pqRecHdr:], b)
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if q.woff > 0 && q.woff+int64(len(rec)) > q.segsz {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.wfd.Write(rec); err != nil {
+		return q.unwrite(err)
+	}
+	if q.fsync {
+		if err := q.wfd.Sync(); err != nil {
+			return q.unwrite(err)
+		}
+	}
+
+	q.woff += int64(len(rec))
+	q.n++
+	q.notEmpty.wakeup()
+	return nil
+}
+
+// unwrite removes a record that failed to be written or synced so
+// that a failed Enq is never replayed and 'woff' matches the end of
+// the segment. Must be called with the lock held.
+func (q *PersistentQ[T]) unwrite(err error) error {
+	if e := q.wfd.Truncate(q.woff); e != nil {
+		return errors.Join(err, fmt.Errorf("persistq: truncate: %w", e))
+	}
+	return err
+}
+
+// Deq removes the oldest element from the queue. The bool retval is
+// false if the queue is empty or on errors; use DeqErr to get the
+// error.
+func (q *PersistentQ[T]) Deq() (T, bool) {
+	x, err := q.DeqErr()
+	return x, err == nil
+}
+
+// DeqErr is like Deq but returns ErrEmpty if the queue is empty,
+// ErrClosed if the queue is closed and empty and the codec or I/O
+// error if the element couldn't be read.
+func (q *PersistentQ[T]) DeqErr() (T, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.deq()
+}
+
+// DeqWait dequeues an element from the queue; if the queue is empty,
+// the caller is blocked until an element is available, the queue is
+// closed or the context is done. It returns ErrClosed if the queue is
+// closed and empty and the context error if the context is done
+// first.
+func (q *PersistentQ[T]) DeqWait(ctx context.Context) (T, error) {
+	q.Lock()
+	for {
+		x, err := q.deq()
+		if err != ErrEmpty {
+			q.Unlock()
+			return x, err
+		}
+
+		ch := q.notEmpty.wait()
+		q.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			var z T
+			return z, ctx.Err()
+		}
+		q.Lock()
+	}
+}
+
+// DeqTimeout is like DeqWait but gives up after the duration 'd'
+func (q *PersistentQ[T]) DeqTimeout(d time.Duration) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.DeqWait(ctx)
+}
+
+// deq removes the oldest element. Must be called with the lock held.
+func (q *PersistentQ[T]) deq() (T, error) {
+	var z T
+
+	if q.released {
+		return z, ErrClosed
+	}
+	if q.n == 0 {
+		if q.closed {
+			return z, ErrClosed
+		}
+		return z, ErrEmpty
+	}
+
+	b, err := q.read()
+	if err != nil {
+		return z, err
+	}
+
+	// a record that can't be decoded is consumed anyway; otherwise it
+	// will block the queue forever.
+	q.roff += int64(pqRecHdr + len(b))
+	q.n--
+	if err := q.checkpoint(); err != nil {
+		return z, err
+	}
+
+	if q.closed && q.n == 0 {
+		// the last element of a closed queue
+		if err := q.release(); err != nil {
+			return z, err
+		}
+	}
+
+	x, err := q.codec.Unmarshal(b)
+	if err != nil {
+		return z, err
+	}
+	return x, nil
+}
+
+// notify returns a channel that is closed when the queue is not
+// empty or closed; it lets a Selector wait on the queue. It returns
+// true if the queue is closed and empty.
+func (q *PersistentQ[T]) notify() (<-chan struct{}, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	switch {
+	case q.released:
+		return nil, true
+	case q.n > 0:
+		return closedch, false
+	case q.closed:
+		return nil, true
+	}
+	return q.notEmpty.wait(), false
+}
+
+// unnotify is a no-op; the waitq needs no cleanup
+func (q *PersistentQ[T]) unnotify() {}
+
+// Len returns the number of elements in the queue
+func (q *PersistentQ[T]) Len() int {
+	q.Lock()
+	n := q.n
+	q.Unlock()
+	return n
+}
+
+// IsEmpty returns true if the queue is empty
+func (q *PersistentQ[T]) IsEmpty() bool {
+	return q.Len() == 0
+}
+
+// Sync flushes the queue contents and the consumer offset to stable
+// storage.
+func (q *PersistentQ[T]) Sync() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if err := q.wfd.Sync(); err != nil {
+		return err
+	}
+	return q.ofd.Sync()
+}
+
+// Close closes the queue for producers; the remaining elements can
+// still be dequeued and blocked consumers are woken up. The writer is
+// synced and closed right away and the other files are released once
+// the queue is drained. The elements that are never dequeued remain
+// on disk for the next OpenPersistentQ; call Shutdown to release the
+// files without draining the queue.
+func (q *PersistentQ[T]) Close() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	return q.close()
+}
+
+// Shutdown closes the queue if it is open and releases its files
+// right away; the elements that are not yet dequeued remain on disk
+// for the next OpenPersistentQ. Blocked consumers are woken up and
+// later dequeues return ErrClosed. Shutdown may be called after Close
+// and more than once.
+func (q *PersistentQ[T]) Shutdown() error {
+	q.Lock()
+	defer q.Unlock()
+
+	var err error
+	if !q.closed {
+		err = q.close()
+	}
+	if !q.released {
+		if e := q.release(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// close closes the queue for producers. Must be called with the lock
+// held.
+func (q *PersistentQ[T]) close() error {
+	q.closed = true
+	q.notEmpty.wakeup()
+
+	err := q.wfd.Sync()
+	if e := q.wfd.Close(); err == nil {
+		err = e
+	}
+	q.wfd = nil
+
+	if q.n == 0 {
+		if e := q.release(); err == nil {
+			err = e
+		}
+	} else if e := q.ofd.Sync(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// IsClosed returns true if the queue is closed
+func (q *PersistentQ[T]) IsClosed() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.closed
+}
+
+// release syncs the consumer offset and closes the files of a closed
+// queue. Must be called with the lock held.
+func (q *PersistentQ[T]) release() error {
+	err := q.ofd.Sync()
+	if e := q.closeFiles(); err == nil {
+		err = e
+	}
+	q.wfd, q.rfd, q.ofd = nil, nil, nil
+	q.released = true
+	return err
+}
+
+// String prints a string representation of the queue
+func (q *PersistentQ[T]) String() string {
+	q.Lock()
+	defer q.Unlock()
+
+	return fmt.Sprintf("<PersistentQ %T %s len=%d segs=%d>", q, q.dir, q.n, len(q.segs))
+}
+
+// read reads the next record's payload, moving to the next segment
+// if needed. Must be called with the lock held.
+func (q *PersistentQ[T]) read() ([]byte, error) {
+	for {
+		b, err := readRecord(q.rfd, q.roff)
+		if err == nil {
+			return b, nil
+		}
+
+		if err != io.EOF || len(q.segs) == 1 {
+			return nil, fmt.Errorf("persistq: segment %d at %d: %w", q.segs[0], q.roff, err)
+		}
+
+		// this segment is consumed; move to the next one
+		if err := q.nextSegment(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextSegment moves the reader to the next segment, checkpoints the
+// new position and deletes the consumed segment.
+func (q *PersistentQ[T]) nextSegment() error {
+	old := q.segs[0]
+	fd, err := os.Open(q.segName(q.segs[1]))
+	if err != nil {
+		return err
+	}
+
+	rfd := q.rfd
+	q.rfd = fd
+	q.roff = 0
+	q.segs = q.segs[1:]
+
+	if err := q.checkpoint(); err != nil {
+		return err
+	}
+	if err := rfd.Close(); err != nil {
+		return fmt.Errorf("persistq: close segment %d: %w", old, err)
+	}
+	return q.removeSegment(old)
+}
+
+// rotate starts a new segment for writing. Must be called with the
+// lock held.
+func (q *PersistentQ[T]) rotate() error {
+	prev := q.segs[len(q.segs)-1]
+
+	// the current segment must be durable before we move past it
+	if err := q.wfd.Sync(); err != nil {
+		return fmt.Errorf("persistq: sync segment %d: %w", prev, err)
+	}
+
+	fd, err := q.createSegment(prev + 1)
+	if err != nil {
+		return err
+	}
+
+	wfd := q.wfd
+	q.wfd = fd
+	q.woff = 0
+	q.segs = append(q.segs, prev+1)
+	if err := wfd.Close(); err != nil {
+		return fmt.Errorf("persistq: close segment %d: %w", prev, err)
+	}
+	return nil
+}
+
+// checkpoint durably records the consumer offset in the next slot of
+// the offset file.
+func (q *PersistentQ[T]) checkpoint() error {
+	var b [pqOffSlot]byte
+
+	q.gen++
+	binary.LittleEndian.PutUint64(b[0:8], q.gen)
+	binary.LittleEndian.PutUint64(b[8:16], q.segs[0])
+	binary.LittleEndian.PutUint64(b[16:24], uint64(q.roff)) //#nosec G115 -- offsets are never negative
+	binary.LittleEndian.PutUint32(b[24:28], crc32.Checksum(b[:24], crcTable))
+
+	off := int64(q.gen%2) * pqOffSlot //#nosec G115 -- 0 or 1
+	if _, err := q.ofd.WriteAt(b[:], off); err != nil {
+		return err
+	}
+	if q.fsync {
+		return q.ofd.Sync()
+	}
+	return nil
+}
+
+// recover opens the queue files and restores the queue state
+func (q *PersistentQ[T]) recover() error {
+	segs, err := q.listSegments()
+	if err != nil {
+		return err
+	}
+
+	q.ofd, err = os.OpenFile(filepath.Join(q.dir, pqOffFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	// the lock is held until the offset file is closed
+	if err := lockFile(q.ofd); err != nil {
+		return err
+	}
+
+	rseg, roff, err := q.readCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	// segments before the consumer offset were consumed but not yet
+	// deleted when we went down.
+	for len(segs) > 0 && segs[0] < rseg {
+		if err := q.removeSegment(segs[0]); err != nil {
+			return err
+		}
+		segs = segs[1:]
+	}
+
+	if len(segs) == 0 || segs[0] != rseg {
+		// the checkpoint refers to a segment that doesn't exist
+		roff = 0
+	}
+
+	if len(segs) == 0 {
+		id := max(rseg, 1)
+		fd, err := q.createSegment(id)
+		if err != nil {
+			return err
+		}
+		fd.Close()
+		segs = append(segs, id)
+	}
+
+	// validate every record that is yet to be consumed
+	q.segs = segs
+	for i, id := range segs {
+		var off int64
+		if i == 0 {
+			off = roff
+		}
+
+		end, n, err := q.scanSegment(id, off)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			roff = min(roff, end)
+		}
+		if i == len(segs)-1 {
+			q.woff = end
+		}
+		q.n += n
+	}
+
+	last := q.segName(segs[len(segs)-1])
+	if q.wfd, err = os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	if q.rfd, err = os.Open(q.segName(segs[0])); err != nil {
+		return err
+	}
+
+	q.roff = roff
+	return q.checkpoint()
+}
+
+// scanSegment validates the records in segment 'id' starting at
+// 'off'; the segment is truncated at the first invalid record. It
+// returns the end of the last valid record and the number of valid
+// records.
+func (q *PersistentQ[T]) scanSegment(id uint64, off int64) (int64, int, error) {
+	fd, err := os.OpenFile(q.segName(id), os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size := st.Size()
+	if off > size {
+		off = size
+	}
+
+	var n int
+	for off < size {
+		b, err := readRecord(fd, off)
+		if err != nil {
+			break
+		}
+		off += int64(pqRecHdr + len(b))
+		n++
+	}
+
+	if off < size {
+		// torn or corrupt tail
+		if err := fd.Truncate(off); err != nil {
+			return 0, 0, err
+		}
+		if err := fd.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return off, n, nil
+}
+
+// readCheckpoint returns the most recent valid consumer offset
+func (q *PersistentQ[T]) readCheckpoint() (uint64, int64, error) {
+	var b [2 * pqOffSlot]byte
+
+	n, err := q.ofd.ReadAt(b[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	var seg, off uint64
+	for i := 0; i+pqOffSlot <= n; i += pqOffSlot {
+		s := b[i : i+pqOffSlot]
+		if crc32.Checksum(s[:24], crcTable) != binary.LittleEndian.Uint32(s[24:28]) {
+			continue
+		}
+
+		if gen := binary.LittleEndian.Uint64(s[0:8]); gen >= q.gen {
+			q.gen = gen
+			seg = binary.LittleEndian.Uint64(s[8:16])
+			off = binary.LittleEndian.Uint64(s[16:24])
+		}
+	}
+	return seg, int64(off), nil //#nosec G115 -- offsets are never negative
+}
+
+// listSegments returns the sorted ids of all the segments in the
+// queue directory
+func (q *PersistentQ[T]) listSegments() ([]uint64, error) {
+	des, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []uint64
+	for _, de := range des {
+		nm := de.Name()
+		if !de.Type().IsRegular() || !strings.HasSuffix(nm, pqSegSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(nm, pqSegSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, id)
+	}
+
+	slices.Sort(segs)
+	return segs, nil
+}
+
+func (q *PersistentQ[T]) createSegment(id uint64) (*os.File, error) {
+	fd, err := os.OpenFile(q.segName(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if q.fsync {
+		if err := q.syncDir(); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+	return fd, nil
+}
+
+func (q *PersistentQ[T]) removeSegment(id uint64) error {
+	if err := os.Remove(q.segName(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if q.fsync {
+		return q.syncDir()
+	}
+	return nil
+}
+
+func (q *PersistentQ[T]) syncDir() error {
+	d, err := os.Open(q.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (q *PersistentQ[T]) segName(id uint64) string {
+	nm := fmt.Sprintf("%0*x%s", pqSegNameLen, id, pqSegSuffix)
+	return filepath.Join(q.dir, nm)
+}
+
+func (q *PersistentQ[T]) closeFiles() error {
+	var err error
+	for _, fd := range []*os.File{q.wfd, q.rfd, q.ofd} {
+		if fd == nil {
+			continue
+		}
+		if e := fd.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// readRecord reads and validates the record at offset 'off'. It
+// returns io.EOF if there is no record at 'off'.
+func readRecord(fd *os.File, off int64) ([]byte, error) {
+	var hdr [pqRecHdr]byte
+
+	n, err := fd.ReadAt(hdr[:], off)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if n < pqRecHdr {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	sz := binary.LittleEndian.Uint32(hdr[0:4])
+	if sz > pqMaxRec {
+		return nil, errors.New("corrupt record length")
+	}
+
+	b := make([]byte, sz)
+	if _, err := fd.ReadAt(b, off+pqRecHdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if crc32.Checksum(b, crcTable) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return b, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
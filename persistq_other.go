@@ -0,0 +1,23 @@
+// persistq_other.go - locking the persistent queue elsewhere
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !unix
+
+package utils
+
+import (
+	"os"
+)
+
+// lockFile is a no-op on platforms without flock(2)
+func lockFile(fd *os.File) error {
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,360 @@
+// persistq_test.go - tests for the persistent queue
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	_ Enqueuer[int]     = &PersistentQ[int]{}
+	_ Dequeuer[int]     = &PersistentQ[int]{}
+	_ waitDequeuer[int] = &PersistentQ[int]{}
+)
+
+type pqRec struct {
+	N    int
+	Name string
+}
+
+func TestPersistentQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	q, err := OpenPersistentQ(dir, GobCodec[pqRec]{})
+	assert(err == nil, "open: %v", err)
+	assert(q.IsEmpty(), "expected q to be empty")
+
+	_, err = q.DeqErr()
+	assert(err == ErrEmpty, "deq on empty q: exp ErrEmpty, saw %v", err)
+
+	for i := 0; i < 10; i++ {
+		err = q.EnqErr(pqRec{i, "rec"})
+		assert(err == nil, "enq-%d: %v", i, err)
+	}
+	for i := 0; i < 4; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil, "deq-%d: %v", i, err)
+		assert(z.N == i && z.Name == "rec", "deq-%d: saw %+v", i, z)
+	}
+	assert(q.Len() == 6, "len: exp 6, saw %d", q.Len())
+	assert(q.Close() == nil, "close failed")
+
+	err = q.EnqErr(pqRec{})
+	assert(err == ErrClosed, "enq on closed q: exp ErrClosed, saw %v", err)
+
+	// the backlog keeps the queue in use until it is released
+	_, err = OpenPersistentQ(dir, GobCodec[pqRec]{})
+	assert(errors.Is(err, ErrLocked), "open in use: exp ErrLocked, saw %v", err)
+	assert(q.Shutdown() == nil, "shutdown failed")
+
+	// reopen and pick up where we left off
+	q, err = OpenPersistentQ(dir, GobCodec[pqRec]{})
+	assert(err == nil, "reopen: %v", err)
+	assert(q.Len() == 6, "len: exp 6, saw %d", q.Len())
+
+	assert(q.EnqErr(pqRec{10, "rec"}) == nil, "enq-10 failed")
+	for i := 4; i <= 10; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil, "deq-%d: %v", i, err)
+		assert(z.N == i, "deq-%d: saw %+v", i, z)
+	}
+	assert(q.IsEmpty(), "expected q to be empty")
+	assert(q.Close() == nil, "close failed")
+}
+
+func TestPersistentQSegments(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	q, err := OpenPersistentQ(dir, JSONCodec[int]{}, WithSegmentSize(64), WithFsync())
+	assert(err == nil, "open: %v", err)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		assert(q.EnqErr(i) == nil, "enq-%d failed", i)
+	}
+
+	segs := func() int {
+		m, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+		return len(m)
+	}
+	nsegs := segs()
+	assert(nsegs > 10, "exp many segments, saw %d", nsegs)
+
+	for i := 0; i < n/2; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil, "deq-%d: %v", i, err)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+
+	// consumed segments must be deleted
+	assert(segs() < nsegs/2+2, "exp old segments to be compacted; saw %d of %d", segs(), nsegs)
+	assert(q.Shutdown() == nil, "shutdown failed")
+
+	q, err = OpenPersistentQ(dir, JSONCodec[int]{}, WithSegmentSize(64))
+	assert(err == nil, "reopen: %v", err)
+	assert(q.Len() == n/2, "len: exp %d, saw %d", n/2, q.Len())
+	for i := n / 2; i < n; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil, "deq-%d: %v", i, err)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+	assert(segs() == 1, "exp 1 segment, saw %d", segs())
+	assert(q.Close() == nil, "close failed")
+}
+
+func TestPersistentQRecovery(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	q, err := OpenPersistentQ(dir, JSONCodec[string]{})
+	assert(err == nil, "open: %v", err)
+
+	for _, s := range []string{"a", "b", "c", "d"} {
+		assert(q.EnqErr(s) == nil, "enq-%s failed", s)
+	}
+	z, _ := q.Deq()
+	assert(z == "a", "deq: exp a, saw %s", z)
+	assert(q.Shutdown() == nil, "shutdown failed")
+
+	m, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert(len(m) == 1, "exp 1 segment, saw %d", len(m))
+	seg := m[0]
+
+	st, err := os.Stat(seg)
+	assert(err == nil, "stat: %v", err)
+	good := st.Size()
+
+	// simulate a torn write: a header that promises more than we have
+	fd, err := os.OpenFile(seg, os.O_WRONLY|os.O_APPEND, 0600)
+	assert(err == nil, "open seg: %v", err)
+	fd.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, '"', 'x'})
+	fd.Close()
+
+	// and a torn write of the latest consumer offset slot
+	off := filepath.Join(dir, "consumer.off")
+	ofd, err := os.OpenFile(off, os.O_RDWR, 0600)
+	assert(err == nil, "open off: %v", err)
+	var b [64]byte
+	ofd.ReadAt(b[:], 0)
+	// the newer slot has the larger generation
+	slot := 0
+	if b[32] > b[0] {
+		slot = 32
+	}
+	ofd.WriteAt([]byte{0xff, 0xff, 0xff}, int64(slot+10))
+	ofd.Close()
+
+	q, err = OpenPersistentQ(dir, JSONCodec[string]{})
+	assert(err == nil, "reopen: %v", err)
+
+	st, err = os.Stat(seg)
+	assert(err == nil, "stat: %v", err)
+	assert(st.Size() == good, "torn tail: exp size %d, saw %d", good, st.Size())
+
+	// the older slot was written before "a" was consumed; so "a" is
+	// delivered again.
+	assert(q.Len() == 4, "len: exp 4, saw %d", q.Len())
+	assert(q.EnqErr("e") == nil, "enq-e failed")
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		z, err := q.DeqErr()
+		assert(err == nil, "deq-%s: %v", s, err)
+		assert(z == s, "deq: exp %s, saw %s", s, z)
+	}
+	assert(q.Close() == nil, "close failed")
+}
+
+func TestPersistentQClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	q, err := OpenPersistentQ(dir, JSONCodec[int]{})
+	assert(err == nil, "open: %v", err)
+
+	for i := 0; i < 3; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	assert(q.Close() == nil, "close failed")
+	assert(q.IsClosed(), "expected q to be closed")
+	assert(errors.Is(q.Close(), ErrClosed), "double close")
+
+	assert(!q.Enq(3), "enq on closed q")
+	err = q.EnqErr(3)
+	assert(errors.Is(err, ErrClosed), "enq: exp ErrClosed, saw %v", err)
+
+	// the remaining elements are still delivered
+	for i := 0; i < 3; i++ {
+		z, err := q.DeqWait(context.Background())
+		assert(err == nil && z == i, "deq: exp %d, saw %d %v", i, z, err)
+	}
+	_, err = q.DeqErr()
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+	_, err = q.DeqWait(context.Background())
+	assert(errors.Is(err, ErrClosed), "deqwait: exp ErrClosed, saw %v", err)
+
+	// the drained queue was checkpointed before the files were released
+	q, err = OpenPersistentQ(dir, JSONCodec[int]{})
+	assert(err == nil, "reopen: %v", err)
+	assert(q.IsEmpty(), "exp empty q, saw %d elements", q.Len())
+	assert(q.Close() == nil, "close failed")
+}
+
+func TestPersistentQShutdown(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	q, err := OpenPersistentQ(dir, JSONCodec[int]{})
+	assert(err == nil, "open: %v", err)
+
+	for i := 0; i < 4; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	z, ok := q.Deq()
+	assert(ok && z == 0, "deq: exp 0, saw %d", z)
+
+	// the backlog keeps the files open after Close; Shutdown
+	// releases them without draining the queue.
+	assert(q.Close() == nil, "close failed")
+	assert(q.rfd != nil && q.ofd != nil, "close released the files of a non-empty q")
+	assert(q.Shutdown() == nil, "shutdown failed")
+	assert(q.wfd == nil && q.rfd == nil && q.ofd == nil, "shutdown didn't release the files")
+	assert(q.Shutdown() == nil, "double shutdown")
+
+	_, err = q.DeqErr()
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+	_, err = q.DeqWait(context.Background())
+	assert(errors.Is(err, ErrClosed), "deqwait: exp ErrClosed, saw %v", err)
+	_, done := q.notify()
+	assert(done, "notify: exp done")
+
+	// the backlog is restored on the next open
+	q, err = OpenPersistentQ(dir, JSONCodec[int]{})
+	assert(err == nil, "reopen: %v", err)
+	assert(q.Len() == 3, "reopen: exp 3 elements, saw %d", q.Len())
+
+	// Shutdown of an open queue wakes up blocked consumers
+	for i := 1; i < 4; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil && z == i, "deq: exp %d, saw %d %v", i, z, err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Shutdown()
+	}()
+	_, err = q.DeqTimeout(5 * time.Second)
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+	assert(q.ofd == nil, "shutdown didn't release the files")
+	assert(errors.Is(q.Close(), ErrClosed), "close after shutdown")
+}
+
+func TestPersistentQUnwrite(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	q, err := OpenPersistentQ(dir, JSONCodec[int]{})
+	assert(err == nil, "open: %v", err)
+	assert(q.Enq(1), "enq failed")
+
+	// a record that was written but failed to sync is removed
+	woff := q.woff
+	_, err = q.wfd.Write([]byte("not a record"))
+	assert(err == nil, "write: %v", err)
+	ioerr := errors.New("sync failed")
+	err = q.unwrite(ioerr)
+	assert(errors.Is(err, ioerr), "unwrite: exp %v, saw %v", ioerr, err)
+
+	st, err := q.wfd.Stat()
+	assert(err == nil, "stat: %v", err)
+	assert(st.Size() == woff, "segment size: exp %d, saw %d", woff, st.Size())
+
+	assert(q.Enq(2), "enq failed")
+	assert(q.Shutdown() == nil, "shutdown failed")
+
+	q, err = OpenPersistentQ(dir, JSONCodec[int]{})
+	assert(err == nil, "reopen: %v", err)
+	assert(q.Len() == 2, "len: exp 2, saw %d", q.Len())
+	for i := 1; i <= 2; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil && z == i, "deq: exp %d, saw %d %v", i, z, err)
+	}
+	assert(q.Close() == nil, "close failed")
+}
+
+func TestPersistentQWait(t *testing.T) {
+	assert := newAsserter(t)
+
+	q, err := OpenPersistentQ(t.TempDir(), JSONCodec[int]{})
+	assert(err == nil, "open: %v", err)
+
+	_, err = q.DeqTimeout(10 * time.Millisecond)
+	assert(errors.Is(err, context.DeadlineExceeded), "deq: exp timeout, saw %v", err)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Enq(1)
+	}()
+	z, err := q.DeqTimeout(5 * time.Second)
+	assert(err == nil && z == 1, "deq: exp 1, saw %d %v", z, err)
+
+	// a blocked consumer is woken up by Close
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Close()
+	}()
+	_, err = q.DeqTimeout(5 * time.Second)
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+}
+
+func TestPersistentQChan(t *testing.T) {
+	assert := newAsserter(t)
+
+	q, err := OpenPersistentQ(t.TempDir(), JSONCodec[int]{})
+	assert(err == nil, "open: %v", err)
+	defer q.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the queue works with the channel adapters and a Selector
+	ch := make(chan int)
+	go func() {
+		for i := 0; i < 4; i++ {
+			ch <- i
+		}
+		close(ch)
+	}()
+	n, err := FromChan(ctx, ch, q, nil)
+	assert(err == nil && n == 0, "fromchan: %d dropped, %v", n, err)
+
+	out := ToChan(ctx, q, nil)
+	for i := 0; i < 2; i++ {
+		z := <-out
+		assert(z == i, "tochan: exp %d, saw %d", i, z)
+	}
+	cancel()
+	for range out {
+	}
+
+	s := NewSelector[int](RoundRobin)
+	s.Add(q, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Enq(9)
+	}()
+
+	// ToChan may have dequeued and dropped one more element
+	for {
+		z, i, err := s.SelectWait(context.Background())
+		assert(err == nil && i == 0, "select: %d %v", i, err)
+		if z == 9 {
+			break
+		}
+		assert(z == 2 || z == 3, "select: saw %d", z)
+	}
+}
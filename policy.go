@@ -0,0 +1,140 @@
+// policy.go - backpressure policies for the bounded queues
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Policy describes what Enq does when a bounded queue is full.
+// The policy only applies to Enq; the explicit variants (EnqErr,
+// EnqWait, EnqTimeout) and PushFront keep their documented behavior.
+type Policy int
+
+const (
+	// DropNewest rejects the new element; Enq returns false. This
+	// is the default.
+	DropNewest Policy = iota
+
+	// DropOldest evicts the oldest element to make room for the new
+	// element; Enq always succeeds. SPSCQ doesn't support this
+	// policy since only the consumer may remove elements.
+	DropOldest
+
+	// Block waits until there is room in the queue; Enq only fails
+	// if the queue is closed. Q doesn't support this policy since
+	// no one else can make room. SPSCQ waits with its wait
+	// strategy.
+	Block
+
+	// Error rejects the new element like DropNewest and records
+	// ErrFull; the queue's Err() method returns the recorded error.
+	// This lets a caller check for overflows once, e.g., after a
+	// batch of Enq calls.
+	Error
+)
+
+// String returns the name of the policy
+func (p Policy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("policy-%d", int(p))
+	}
+}
+
+// QOption is a functional option for the constructors of Q, SyncQ
+// and SPSCQ
+type QOption[T any] func(o *qPolicy[T])
+
+// WithPolicy sets the backpressure policy of the queue
+func WithPolicy[T any](p Policy) QOption[T] {
+	return func(o *qPolicy[T]) {
+		o.policy = p
+	}
+}
+
+// WithDropFunc sets a callback that is invoked with each element
+// dropped by the backpressure policy: the new element for DropNewest
+// and Error and the evicted element for DropOldest. The callback is invoked
+// without holding any queue locks.
+func WithDropFunc[T any](fn func(T)) QOption[T] {
+	return func(o *qPolicy[T]) {
+		o.drop = fn
+	}
+}
+
+// WithWaitStrategy sets the strategy that SPSCQ uses to wait in
+// EnqWait, DeqWait and with the Block policy; the default is
+// NewSpinYield(DefaultSpins). The other queues ignore this option.
+func WithWaitStrategy[T any](ws WaitStrategy) QOption[T] {
+	return func(o *qPolicy[T]) {
+		o.wait = ws
+	}
+}
+
+// qPolicy holds the queue options: the backpressure policy and the
+// wait strategy
+type qPolicy[T any] struct {
+	policy Policy
+	drop   func(T)
+	wait   WaitStrategy
+
+	// set when an Enq failed under the Error policy
+	full *atomic.Bool
+}
+
+func newPolicy[T any](nm string, opts []QOption[T], unsupported ...Policy) qPolicy[T] {
+	var p qPolicy[T]
+
+	for _, fp := range opts {
+		fp(&p)
+	}
+
+	for _, u := range unsupported {
+		if p.policy == u {
+			panic(fmt.Sprintf("%s: policy %s is not supported", nm, u))
+		}
+	}
+
+	if p.policy == Error {
+		p.full = &atomic.Bool{}
+	}
+	return p
+}
+
+// dropped disposes of an element dropped due to a full queue
+func (p *qPolicy[T]) dropped(x T) {
+	if p.full != nil {
+		p.full.Store(true)
+	}
+	if p.drop != nil {
+		p.drop(x)
+	}
+}
+
+// err returns ErrFull if an element was rejected under the Error
+// policy since the last call and clears it.
+func (p *qPolicy[T]) err() error {
+	if p.full != nil && p.full.Swap(false) {
+		return ErrFull
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,162 @@
+// policy_test.go - tests for queue backpressure policies
+
+package utils
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPolicyDropNewest(t *testing.T) {
+	assert := newAsserter(t)
+
+	var drops []int
+	q := NewQ(4, WithDropFunc(func(x int) { drops = append(drops, x) }))
+
+	for i := 0; i < 6; i++ {
+		ok := q.Enq(i)
+		assert(ok == (i < 4), "enq-%d: saw %v", i, ok)
+	}
+	assert(len(drops) == 2, "drops: exp 2, saw %d", len(drops))
+	assert(drops[0] == 4 && drops[1] == 5, "drops: saw %v", drops)
+
+	for i := 0; i < 4; i++ {
+		z, ok := q.Deq()
+		assert(ok && z == i, "deq: exp %d, saw %d", i, z)
+	}
+}
+
+func TestPolicyDropOldest(t *testing.T) {
+	assert := newAsserter(t)
+
+	var drops []int
+	q := NewSyncQ(4, WithPolicy[int](DropOldest),
+		WithDropFunc(func(x int) { drops = append(drops, x) }))
+
+	for i := 0; i < 7; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	assert(q.Len() == 4, "len: exp 4, saw %d", q.Len())
+	assert(len(drops) == 3, "drops: exp 3, saw %d", len(drops))
+	for i, x := range drops {
+		assert(x == i, "drop-%d: saw %d", i, x)
+	}
+
+	for i := 3; i < 7; i++ {
+		z, ok := q.Deq()
+		assert(ok && z == i, "deq: exp %d, saw %d", i, z)
+	}
+
+	// the explicit variants don't evict
+	for q.EnqErr(0) == nil {
+	}
+	assert(q.Len() == 4, "len: exp 4, saw %d", q.Len())
+}
+
+func TestPolicyError(t *testing.T) {
+	assert := newAsserter(t)
+
+	type errQ interface {
+		Enq(int) bool
+		Deq() (int, bool)
+		Err() error
+	}
+
+	var drops []int
+	drop := WithDropFunc(func(x int) { drops = append(drops, x) })
+	qs := map[string]errQ{
+		"Q":     NewQ(2, WithPolicy[int](Error), drop),
+		"SyncQ": NewSyncQ(2, WithPolicy[int](Error), drop),
+		"SPSCQ": NewSPSCQ(2, WithPolicy[int](Error), drop),
+	}
+	for nm, q := range qs {
+		drops = drops[:0]
+		assert(q.Enq(1) && q.Enq(2), "%s: enq failed", nm)
+		assert(q.Err() == nil, "%s: unexpected err %v", nm, q.Err())
+
+		// a full queue rejects the element without panicking
+		assert(!q.Enq(3), "%s: enq on a full queue succeeded", nm)
+		assert(!q.Enq(4), "%s: enq on a full queue succeeded", nm)
+		assert(len(drops) == 2 && drops[0] == 3 && drops[1] == 4, "%s: drops: saw %v", nm, drops)
+
+		// the error is reported once
+		err := q.Err()
+		assert(errors.Is(err, ErrFull), "%s: exp ErrFull, saw %v", nm, err)
+		assert(q.Err() == nil, "%s: err not cleared", nm)
+
+		x, ok := q.Deq()
+		assert(ok && x == 1, "%s: deq: exp 1, saw %d", nm, x)
+		assert(q.Enq(5), "%s: enq after deq failed", nm)
+		assert(q.Err() == nil, "%s: unexpected err %v", nm, q.Err())
+	}
+
+	// the other policies never record an error
+	q := NewQ[int](1)
+	q.Enq(1)
+	q.Enq(2)
+	assert(q.Err() == nil, "drop-newest: unexpected err %v", q.Err())
+}
+
+func TestPolicyBlock(t *testing.T) {
+	assert := newAsserter(t)
+
+	const N = 1000
+
+	sq := NewSyncQ(1, WithPolicy[int](Block))
+	pq := NewSPSCQ(1, WithPolicy[int](Block))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		for i := 0; i < N; i++ {
+			sq.Enq(i)
+		}
+		wg.Done()
+	}()
+	go func() {
+		for i := 0; i < N; i++ {
+			pq.Enq(i)
+		}
+		wg.Done()
+	}()
+
+	for i := 0; i < N; i++ {
+		z, err := sq.DeqTimeout(5 * time.Second)
+		assert(err == nil && z == i, "syncq: exp %d, saw %d %v", i, z, err)
+
+		for {
+			if z, ok := pq.Deq(); ok {
+				assert(z == i, "spscq: exp %d, saw %d", i, z)
+				break
+			}
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+
+	// a blocked producer is released by Close
+	for sq.EnqErr(0) == nil {
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sq.Close()
+	}()
+	assert(!sq.Enq(1), "enq on closed queue succeeded")
+}
+
+func TestPolicyUnsupported(t *testing.T) {
+	assert := newAsserter(t)
+
+	mustPanic := func(nm string, fp func()) {
+		defer func() {
+			assert(recover() != nil, "%s: exp panic", nm)
+		}()
+		fp()
+	}
+
+	mustPanic("Q", func() { NewQ(4, WithPolicy[int](Block)) })
+	mustPanic("SPSCQ", func() { NewSPSCQ(4, WithPolicy[int](DropOldest)) })
+}
@@ -0,0 +1,385 @@
+// pq.go - Generic binary heap based priority queue
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PQ[T] is a generic priority queue backed by a binary heap. The
+// caller supplied function 'less(a, b)' returns true if 'a' has a
+// higher priority than 'b' - i.e., 'a' must be dequeued before 'b'.
+// A bounded PQ evicts its lowest priority element when it is full.
+type PQ[T any] struct {
+	less func(a, b T) bool
+	h    []*PQItem[T]
+	max  int // 0 => unbounded
+}
+
+// PQItem[T] is a handle to an element in a PQ[T]; it can be used
+// to update or remove the element.
+type PQItem[T any] struct {
+	v   T
+	idx int // index in the heap; -1 if not in a queue
+}
+
+// Value returns the element referred to by this handle
+func (it *PQItem[T]) Value() T {
+	return it.v
+}
+
+// Make a new unbounded priority queue ordered by 'less'
+func NewPQ[T any](less func(a, b T) bool) *PQ[T] {
+	p := &PQ[T]{}
+	p.init(0, less)
+	return p
+}
+
+// Make a new bounded priority queue ordered by 'less' that holds at
+// most 'n' elements.
+func NewBoundedPQ[T any](n int, less func(a, b T) bool) *PQ[T] {
+	if n <= 0 {
+		panic(fmt.Sprintf("pq: invalid size %d", n))
+	}
+
+	p := &PQ[T]{}
+	p.init(n, less)
+	return p
+}
+
+func (p *PQ[T]) init(n int, less func(a, b T) bool) {
+	p.less = less
+	p.max = n
+	p.h = make([]*PQItem[T], 0, n)
+}
+
+// Push inserts a new element and returns a handle to it. If the
+// queue is bounded and full, the lowest priority element is evicted;
+// Push returns nil if the evicted element is 'x' itself.
+func (p *PQ[T]) Push(x T) *PQItem[T] {
+	it, _, _ := p.PushEvict(x)
+	return it
+}
+
+// PushEvict is like Push but additionally returns the evicted element
+// and true if an element was evicted. If 'x' has the lowest priority
+// of all the elements in a full queue, 'x' is the evicted element
+// and the returned handle is nil.
+func (p *PQ[T]) PushEvict(x T) (*PQItem[T], T, bool) {
+	var z T
+
+	if p.max == 0 || len(p.h) < p.max {
+		it := &PQItem[T]{v: x, idx: len(p.h)}
+		p.h = append(p.h, it)
+		p.up(it.idx)
+		return it, z, false
+	}
+
+	// the lowest priority element is one of the leaves
+	w := len(p.h) / 2
+	for i := w + 1; i < len(p.h); i++ {
+		if p.less(p.h[w].v, p.h[i].v) {
+			w = i
+		}
+	}
+
+	old := p.h[w]
+	if !p.less(x, old.v) {
+		return nil, x, true
+	}
+
+	it := &PQItem[T]{v: x, idx: w}
+	p.h[w] = it
+	old.idx = -1
+	p.up(w)
+	return it, old.v, true
+}
+
+// Pop removes the highest priority element; return false if the
+// queue is empty.
+func (p *PQ[T]) Pop() (T, bool) {
+	if len(p.h) == 0 {
+		var z T
+		return z, false
+	}
+
+	it := p.del(0)
+	return it.v, true
+}
+
+// Peek returns the highest priority element without removing it;
+// return false if the queue is empty.
+func (p *PQ[T]) Peek() (T, bool) {
+	if len(p.h) == 0 {
+		var z T
+		return z, false
+	}
+	return p.h[0].v, true
+}
+
+// Update replaces the element referred to by 'it' with 'x' and
+// restores the heap order. Return false if 'it' is not in this queue.
+func (p *PQ[T]) Update(it *PQItem[T], x T) bool {
+	if !p.owns(it) {
+		return false
+	}
+
+	it.v = x
+	p.fix(it.idx)
+	return true
+}
+
+// Remove deletes the element referred to by 'it' from the queue.
+// Return false if 'it' is not in this queue.
+func (p *PQ[T]) Remove(it *PQItem[T]) bool {
+	if !p.owns(it) {
+		return false
+	}
+
+	p.del(it.idx)
+	return true
+}
+
+// Flush empties the queue
+func (p *PQ[T]) Flush() {
+	for _, it := range p.h {
+		it.idx = -1
+	}
+	clear(p.h)
+	p.h = p.h[:0]
+}
+
+// Len returns the number of elements in the queue
+func (p *PQ[T]) Len() int {
+	return len(p.h)
+}
+
+// Size returns the capacity of a bounded queue and 0 for an
+// unbounded queue.
+func (p *PQ[T]) Size() int {
+	return p.max
+}
+
+// IsEmpty returns true if the queue is empty
+func (p *PQ[T]) IsEmpty() bool {
+	return len(p.h) == 0
+}
+
+// IsFull returns true if a bounded queue is full
+func (p *PQ[T]) IsFull() bool {
+	return p.max > 0 && len(p.h) >= p.max
+}
+
+// String dumps the queue in human readable form
+func (p *PQ[T]) String() string {
+	return p.repr("PQ")
+}
+
+func (p *PQ[T]) repr(nm string) string {
+	var pref string
+	if p.IsFull() {
+		pref = "[FULL] "
+	} else if p.IsEmpty() {
+		pref = "[EMPTY] "
+	}
+	return fmt.Sprintf("<%s %T %scap=%d len=%d>", nm, p, pref, p.max, len(p.h))
+}
+
+func (p *PQ[T]) owns(it *PQItem[T]) bool {
+	return it != nil && it.idx >= 0 && it.idx < len(p.h) && p.h[it.idx] == it
+}
+
+// del removes and returns the element at index 'i'
+func (p *PQ[T]) del(i int) *PQItem[T] {
+	n := len(p.h) - 1
+	it := p.h[i]
+	if i != n {
+		p.swap(i, n)
+	}
+
+	p.h[n] = nil
+	p.h = p.h[:n]
+	if i != n {
+		p.fix(i)
+	}
+
+	it.idx = -1
+	return it
+}
+
+// fix restores the heap order after the element at 'i' has changed
+func (p *PQ[T]) fix(i int) {
+	if !p.down(i) {
+		p.up(i)
+	}
+}
+
+func (p *PQ[T]) up(i int) {
+	for i > 0 {
+		j := (i - 1) / 2
+		if !p.less(p.h[i].v, p.h[j].v) {
+			break
+		}
+		p.swap(i, j)
+		i = j
+	}
+}
+
+// down moves the element at 'i' towards the leaves; return true if
+// it moved.
+func (p *PQ[T]) down(i int) bool {
+	n := len(p.h)
+	k := i
+	for {
+		j := 2*k + 1
+		if j >= n {
+			break
+		}
+		if r := j + 1; r < n && p.less(p.h[r].v, p.h[j].v) {
+			j = r
+		}
+		if !p.less(p.h[j].v, p.h[k].v) {
+			break
+		}
+		p.swap(k, j)
+		k = j
+	}
+	return k > i
+}
+
+func (p *PQ[T]) swap(i, j int) {
+	h := p.h
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+
+// SyncPQ[T] is a thread-safe version of PQ[T]. The Value() of a
+// handle must not be read concurrently with an Update of the same
+// handle.
+type SyncPQ[T any] struct {
+	PQ[T]
+	sync.Mutex
+}
+
+// Make a new thread-safe, unbounded priority queue ordered by 'less'
+func NewSyncPQ[T any](less func(a, b T) bool) *SyncPQ[T] {
+	p := &SyncPQ[T]{}
+	p.init(0, less)
+	return p
+}
+
+// Make a new thread-safe, bounded priority queue ordered by 'less'
+// that holds at most 'n' elements.
+func NewBoundedSyncPQ[T any](n int, less func(a, b T) bool) *SyncPQ[T] {
+	if n <= 0 {
+		panic(fmt.Sprintf("pq: invalid size %d", n))
+	}
+
+	p := &SyncPQ[T]{}
+	p.init(n, less)
+	return p
+}
+
+// Push inserts a new element and returns a handle to it. See
+// PQ.Push() for the behavior of a full bounded queue.
+func (p *SyncPQ[T]) Push(x T) *PQItem[T] {
+	p.Lock()
+	it := p.PQ.Push(x)
+	p.Unlock()
+	return it
+}
+
+// PushEvict inserts a new element and returns a handle to it along
+// with the evicted element if any. See PQ.PushEvict().
+func (p *SyncPQ[T]) PushEvict(x T) (*PQItem[T], T, bool) {
+	p.Lock()
+	it, old, ok := p.PQ.PushEvict(x)
+	p.Unlock()
+	return it, old, ok
+}
+
+// Pop removes the highest priority element. The bool retval is false
+// if the queue is empty and true otherwise.
+func (p *SyncPQ[T]) Pop() (T, bool) {
+	p.Lock()
+	a, b := p.PQ.Pop()
+	p.Unlock()
+	return a, b
+}
+
+// Peek returns the highest priority element without removing it. The
+// bool retval is false if the queue is empty and true otherwise.
+func (p *SyncPQ[T]) Peek() (T, bool) {
+	p.Lock()
+	a, b := p.PQ.Peek()
+	p.Unlock()
+	return a, b
+}
+
+// Update replaces the element referred to by 'it' with 'x'; return
+// false if 'it' is not in this queue.
+func (p *SyncPQ[T]) Update(it *PQItem[T], x T) bool {
+	p.Lock()
+	r := p.PQ.Update(it, x)
+	p.Unlock()
+	return r
+}
+
+// Remove deletes the element referred to by 'it'; return false if
+// 'it' is not in this queue.
+func (p *SyncPQ[T]) Remove(it *PQItem[T]) bool {
+	p.Lock()
+	r := p.PQ.Remove(it)
+	p.Unlock()
+	return r
+}
+
+// Flush empties the queue
+func (p *SyncPQ[T]) Flush() {
+	p.Lock()
+	p.PQ.Flush()
+	p.Unlock()
+}
+
+// Len returns the number of elements in the queue
+func (p *SyncPQ[T]) Len() int {
+	p.Lock()
+	r := p.PQ.Len()
+	p.Unlock()
+	return r
+}
+
+// IsEmpty returns true if the queue is empty and false otherwise
+func (p *SyncPQ[T]) IsEmpty() bool {
+	p.Lock()
+	r := p.PQ.IsEmpty()
+	p.Unlock()
+	return r
+}
+
+// IsFull returns true if a bounded queue is full and false otherwise
+func (p *SyncPQ[T]) IsFull() bool {
+	p.Lock()
+	r := p.PQ.IsFull()
+	p.Unlock()
+	return r
+}
+
+// String prints a string representation of the queue
+func (p *SyncPQ[T]) String() string {
+	p.Lock()
+	s := p.repr("SyncPQ")
+	p.Unlock()
+	return s
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,152 @@
+// pq_test.go - tests for priority queues
+
+package utils
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func intLess(a, b int) bool {
+	return a < b
+}
+
+func TestPQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	p := NewPQ(intLess)
+	_, ok := p.Pop()
+	assert(!ok, "pop on empty pq should fail")
+	_, ok = p.Peek()
+	assert(!ok, "peek on empty pq should fail")
+
+	v := rand.Perm(1000)
+	for _, x := range v {
+		p.Push(x)
+	}
+	assert(p.Len() == len(v), "len: exp %d, saw %d", len(v), p.Len())
+
+	z, ok := p.Peek()
+	assert(ok && z == 0, "peek: exp 0, saw %d", z)
+
+	for i := 0; i < len(v); i++ {
+		z, ok := p.Pop()
+		assert(ok, "pop-%d failed", i)
+		assert(z == i, "pop: exp %d, saw %d", i, z)
+	}
+	assert(p.IsEmpty(), "expected pq to be empty")
+}
+
+func TestPQHandles(t *testing.T) {
+	assert := newAsserter(t)
+
+	p := NewPQ(intLess)
+	h := make([]*PQItem[int], 10)
+	for i := range h {
+		h[i] = p.Push(i * 10)
+	}
+
+	// move the largest to the front and the smallest to the back
+	assert(p.Update(h[9], -1), "update h9 failed")
+	assert(p.Update(h[0], 1000), "update h0 failed")
+	assert(h[9].Value() == -1, "value: exp -1, saw %d", h[9].Value())
+
+	assert(p.Remove(h[5]), "remove h5 failed")
+	assert(!p.Remove(h[5]), "remove h5 twice should fail")
+	assert(!p.Update(h[5], 5), "update of removed h5 should fail")
+
+	exp := []int{-1, 10, 20, 30, 40, 60, 70, 80, 1000}
+	var got []int
+	for !p.IsEmpty() {
+		z, _ := p.Pop()
+		got = append(got, z)
+	}
+	assert(slices.Equal(got, exp), "exp %v, saw %v", exp, got)
+
+	// handles from another queue must be rejected
+	q := NewPQ(intLess)
+	x := q.Push(1)
+	p.Push(1)
+	assert(!p.Remove(x), "remove of foreign handle should fail")
+}
+
+func TestBoundedPQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	p := NewBoundedPQ(5, intLess)
+	for _, x := range []int{50, 10, 40, 20, 30} {
+		_, _, ev := p.PushEvict(x)
+		assert(!ev, "push-%d: unexpected eviction", x)
+	}
+	assert(p.IsFull(), "expected pq to be full\n%s", p)
+
+	// lower priority than everything; rejected
+	it, old, ev := p.PushEvict(60)
+	assert(it == nil, "push-60: exp nil handle")
+	assert(ev && old == 60, "push-60: exp eviction of 60, saw %d", old)
+
+	it, old, ev = p.PushEvict(5)
+	assert(it != nil, "push-5: exp handle")
+	assert(ev && old == 50, "push-5: exp eviction of 50, saw %d", old)
+
+	it = p.Push(25)
+	assert(it != nil, "push-25: exp handle")
+	assert(p.Len() == 5, "len: exp 5, saw %d", p.Len())
+
+	exp := []int{5, 10, 20, 25, 30}
+	var got []int
+	for !p.IsEmpty() {
+		z, _ := p.Pop()
+		got = append(got, z)
+	}
+	assert(slices.Equal(got, exp), "exp %v, saw %v", exp, got)
+
+	// random workload: the bounded pq keeps the 'n' smallest
+	v := rand.Perm(1000)
+	for _, x := range v {
+		p.Push(x)
+	}
+	for i := 0; i < 5; i++ {
+		z, ok := p.Pop()
+		assert(ok && z == i, "pop: exp %d, saw %d", i, z)
+	}
+}
+
+func TestSyncPQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	const (
+		nprod = 4
+		iters = 1000
+	)
+
+	p := NewSyncPQ(intLess)
+
+	var wg sync.WaitGroup
+	wg.Add(nprod)
+	for i := 0; i < nprod; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iters; j++ {
+				h := p.Push(j*nprod + i)
+				if j%10 == 0 {
+					p.Remove(h)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n := nprod * iters * 9 / 10
+	assert(p.Len() == n, "len: exp %d, saw %d", n, p.Len())
+
+	prev := -1
+	for !p.IsEmpty() {
+		z, ok := p.Pop()
+		assert(ok, "pop failed")
+		assert(z > prev, "pop: %d after %d", z, prev)
+		prev = z
+	}
+}
@@ -10,39 +10,50 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"iter"
+	"slices"
 	"sync"
+	"time"
 )
 
 // Notes:
-//   - read from 'rd', write to 'wr+1'.
+//   - rd, wr are free running counters; they are masked on access
+//   - read from 'rd', write to 'wr'.
 //   - queue size always a power-of-2
-//   - for a queue of capacity N, it will store N-1 usable elements
-//   - queue-empty: rd   == wr
-//   - queue-full:  wr+1 == rd
+//   - for a queue of capacity N, it will store N elements
+//   - queue-empty: rd == wr
+//   - queue-full:  wr - rd == N
 
 // Q[T] is a generic fixed-size queue. This queue always has a
 // power-of-2 size.  For a queue with capacity 'N', it will store
-// N-1 queue elements.
+// N queue elements.
 type Q[T any] struct {
 	wr, rd uint64
 	mask   uint64 // size-1 (qhen size is a power-of-2
 
-	q []T
+	q   []T
+	st  *QStats // nil unless stats are enabled
+	pol qPolicy[T]
 }
 
 // Make a new Queue instance to hold (at least) 'n' slots. If 'n' is
 // NOT a power-of-2, this function will pick the next closest
-// power-of-2.
-func NewQ[T any](n int) *Q[T] {
-	q := &Q[T]{}
+// power-of-2. The Block policy is not supported.
+func NewQ[T any](n int, opts ...QOption[T]) *Q[T] {
+	q := &Q[T]{
+		pol: newPolicy("Q", opts, Block),
+	}
 	q.init(n)
 	return q
 }
 
 // NewQFrom makes a new queue with contents from the initial list
-func NewQFrom[T any](v []T) *Q[T] {
-	q := &Q[T]{}
+func NewQFrom[T any](v []T, opts ...QOption[T]) *Q[T] {
+	q := &Q[T]{
+		pol: newPolicy("Q", opts, Block),
+	}
 	q.init2(v)
 	return q
 }
@@ -57,8 +68,26 @@ func (q *Q[T]) init(n int) {
 
 func (q *Q[T]) init2(v []T) {
 	q.init(len(v))
-	n := copy(q.q[1:], v)
+	n := copy(q.q, v)
+	q.wr = uint64(n) //#nosec G115 -- 64 bit platforms
+}
+
+// resize moves the queue contents in FIFO order to a new backing
+// slice with 'z' slots. 'z' must be a power-of-2 and large enough to
+// hold all the current elements.
+func (q *Q[T]) resize(z uint64) {
+	n := q.Len()
+	b := make([]T, z)
+
+	// elements live in [rd, wr) and may wrap around the end
+	i := q.rd & q.mask
+	k := copy(b[:n], q.q[i:])
+	copy(b[k:n], q.q[:n-k])
+
+	q.rd = 0
 	q.wr = uint64(n) //#nosec G115 -- 64 bit platforms
+	q.mask = z - 1
+	q.q = b
 }
 
 // Empty the queue
@@ -67,51 +96,240 @@ func (q *Q[T]) Flush() {
 	q.rd = 0
 }
 
-// Insert new element; return false if queue full
+// Insert new element; if the queue is full, the queue policy decides
+// the outcome. Return false if the element was not inserted.
 func (q *Q[T]) Enq(x T) bool {
-	wr := (1 + q.wr) & q.mask
-	if wr == q.rd {
+	// fast path: there's room and stats are off
+	wr := q.wr
+	if wr-q.rd < uint64(len(q.q)) && q.st == nil {
+		q.q[wr&q.mask] = x
+		q.wr = wr + 1
+		return true
+	}
+
+	if q.put(x) {
+		return true
+	}
+
+	ok, d, _ := q.overflow(x)
+	q.pol.dropped(d)
+	return ok
+}
+
+// enq inserts 'x' and applies the DropOldest policy when the queue is
+// full. It returns true if 'x' was inserted along with the element
+// that must be dropped, if any.
+func (q *Q[T]) enq(x T) (bool, T, bool) {
+	if q.put(x) {
+		var z T
+		return true, z, false
+	}
+	return q.overflow(x)
+}
+
+// overflow applies the DropOldest policy to 'x' on a full queue; the
+// return values are the same as enq().
+func (q *Q[T]) overflow(x T) (bool, T, bool) {
+	if q.pol.policy == DropOldest {
+		old := q.evict()
+		q.put(x)
+		return true, old, true
+	}
+	return false, x, true
+}
+
+// put inserts a new element; return false if queue full
+func (q *Q[T]) put(x T) bool {
+	wr := q.wr
+	if wr-q.rd == uint64(len(q.q)) {
+		if q.st != nil {
+			q.st.EnqFull++
+		}
 		return false
 	}
 
-	q.q[wr] = x
-	q.wr = wr
+	q.q[wr&q.mask] = x
+	q.wr = wr + 1
+	if q.st != nil {
+		q.st.enq(q.Len())
+	}
 	return true
 }
 
+// enqOverwrite inserts a new element, evicting the oldest element if
+// the queue is full. It returns the evicted element and true if an
+// element was evicted.
+func (q *Q[T]) enqOverwrite(x T) (T, bool) {
+	var old T
+	var evicted bool
+
+	if q.IsFull() {
+		old, evicted = q.evict(), true
+	}
+	q.put(x)
+	return old, evicted
+}
+
+// evict removes the oldest element of a full queue to make room for
+// a new element; it is counted apart from the dequeues.
+func (q *Q[T]) evict() T {
+	x := q.q[q.rd&q.mask]
+	q.rd++
+	if q.st != nil {
+		q.st.Evicted++
+	}
+	return x
+}
+
 // Remove oldest element; return false if queue empty
 func (q *Q[T]) Deq() (T, bool) {
 	rd := q.rd
 	if rd == q.wr {
+		if q.st != nil {
+			q.st.DeqEmpty++
+		}
 		var z T
 		return z, false
 	}
 
-	rd = (rd + 1) & q.mask
-	q.rd = rd
-	return q.q[rd], true
+	x := q.q[rd&q.mask]
+	q.rd = rd + 1
+	if q.st != nil {
+		q.st.Deq++
+	}
+	return x, true
+}
+
+// Insert new element at the head of the queue; return false if
+// queue full. The element will be the next one returned by Deq.
+func (q *Q[T]) PushFront(x T) bool {
+	if q.IsFull() {
+		if q.st != nil {
+			q.st.EnqFull++
+		}
+		return false
+	}
+
+	q.rd--
+	q.q[q.rd&q.mask] = x
+	if q.st != nil {
+		q.st.enq(q.Len())
+	}
+	return true
+}
+
+// Remove newest element; return false if queue empty
+func (q *Q[T]) PopBack() (T, bool) {
+	if q.wr == q.rd {
+		if q.st != nil {
+			q.st.DeqEmpty++
+		}
+		var z T
+		return z, false
+	}
+
+	q.wr--
+	if q.st != nil {
+		q.st.Deq++
+	}
+	return q.q[q.wr&q.mask], true
+}
+
+// Return the oldest element without removing it; return false if
+// queue empty
+func (q *Q[T]) PeekFront() (T, bool) {
+	if q.rd == q.wr {
+		var z T
+		return z, false
+	}
+	return q.q[q.rd&q.mask], true
+}
+
+// Return the newest element without removing it; return false if
+// queue empty
+func (q *Q[T]) PeekBack() (T, bool) {
+	if q.rd == q.wr {
+		var z T
+		return z, false
+	}
+	return q.q[(q.wr-1)&q.mask], true
+}
+
+// Return the i'th element from the head of the queue (0 is the
+// oldest); return false if 'i' is out of range
+func (q *Q[T]) At(i int) (T, bool) {
+	if i < 0 || i >= q.Len() {
+		var z T
+		return z, false
+	}
+
+	j := (q.rd + uint64(i)) & q.mask //#nosec G115 -- i is non-negative
+	return q.q[j], true
+}
+
+// All returns an iterator over the elements of the queue from the
+// oldest to the newest; the queue is not modified. The queue must not
+// be modified during the iteration.
+func (q *Q[T]) All() iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for rd := q.rd; rd != q.wr; rd++ {
+			if !yield(q.q[rd&q.mask]) {
+				return
+			}
+		}
+	}
+}
+
+// Drain returns an iterator that dequeues each element of the queue
+// from the oldest to the newest. Elements not consumed by the caller
+// remain in the queue.
+func (q *Q[T]) Drain() iter.Seq[T] {
+	return drain(q.Deq)
+}
+
+// EnableStats turns on the collection of runtime statistics for
+// this queue.
+func (q *Q[T]) EnableStats() {
+	if q.st == nil {
+		q.st = &QStats{}
+	}
+}
+
+// Err returns ErrFull if an Enq was rejected under the Error policy
+// since the last call to Err and nil otherwise; use EnqErr for the
+// outcome of a single enqueue. Err is safe to call from any go-routine.
+func (q *Q[T]) Err() error {
+	return q.pol.err()
+}
+
+// Stats returns a snapshot of the runtime statistics of this queue;
+// the statistics are all zero if they were never enabled. Like the
+// rest of Q, Stats must only be called by the owner of the queue.
+func (q *Q[T]) Stats() QStats {
+	if q.st == nil {
+		return QStats{}
+	}
+	return *q.st
 }
 
 // Return true if queue is empty
 func (q *Q[T]) IsEmpty() bool {
-	return qempty(q.rd, q.wr, q.mask)
+	return qempty(q.rd, q.wr)
 }
 
 // Return true if queue is full
 func (q *Q[T]) IsFull() bool {
-	return qfull(q.rd, q.wr, q.mask)
+	return qfull(q.rd, q.wr, uint64(len(q.q)))
 }
 
 // Return number of valid/usable elements
 func (q *Q[T]) Len() int {
-	return qlen(q.rd, q.wr, q.mask)
+	return qlen(q.rd, q.wr)
 }
 
 // Return total capacity of the queue
 func (q *Q[T]) Size() int {
-	// Due to the q-full and q-empty conditions, we will
-	// always have one unused slot.
-	return len(q.q) - 1
+	return len(q.q)
 }
 
 // Dump queue in human readable form
@@ -120,63 +338,364 @@ func (q *Q[T]) String() string {
 }
 
 func (q *Q[T]) repr(nm string) string {
-	suff := qrepr(q.rd, q.wr, q.mask)
+	suff := qrepr(q.rd, q.wr, uint64(len(q.q)))
 
 	return fmt.Sprintf("<%s %T %s>", nm, q, suff)
 }
 
 // SyncQ[T] is a generic, thread-safe, fixed-size queue. This queue
 // always has a power-of-2 size. For a queue with capacity 'N', it will
-// store N-1 queue elements.
+// store N queue elements.
 type SyncQ[T any] struct {
 	Q[T]
 	sync.Mutex
+
+	// waiters blocked in EnqWait() and DeqWait() respectively
+	notFull  waitq
+	notEmpty waitq
+
+	closed bool
 }
 
 // Make a new thread-safe queue instance to hold (at least) 'n' slots.
 // If 'n' is NOT a power-of-2, this function will pick the next closest
 // power-of-2.
-func NewSyncQ[T any](n int) *SyncQ[T] {
+func NewSyncQ[T any](n int, opts ...QOption[T]) *SyncQ[T] {
 	q := &SyncQ[T]{}
+	q.pol = newPolicy("SyncQ", opts)
 	q.init(n)
 	return q
 }
 
 // NewSyncQFrom makes a new queue with contents from the initial list
-func NewSyncQFrom[T any](v []T) *SyncQ[T] {
+func NewSyncQFrom[T any](v []T, opts ...QOption[T]) *SyncQ[T] {
 	q := &SyncQ[T]{}
+	q.pol = newPolicy("SyncQ", opts)
 	q.init2(v)
 	return q
 }
 
 // Flush empties the queue
 func (q *SyncQ[T]) Flush() {
-	q.Lock()
+	q.lock()
 	q.Q.Flush()
+	q.notFull.wakeup()
 	q.Unlock()
 }
 
-// Enq enqueues a new element to the queue, return false if the queue is full
-// and true otherwise.
+// Enq enqueues a new element to the queue; if the queue is full, the
+// queue policy decides the outcome. Return false if the element was not
+// enqueued or the queue is closed and true otherwise.
 func (q *SyncQ[T]) Enq(x T) bool {
-	q.Lock()
-	r := q.Q.Enq(x)
+	if q.pol.policy == Block {
+		return q.EnqWait(context.Background(), x) == nil
+	}
+
+	q.lock()
+	if q.closed {
+		q.Unlock()
+		return false
+	}
+
+	ok, d, dropped := q.Q.enq(x)
+	if ok {
+		q.notEmpty.wakeup()
+	}
 	q.Unlock()
-	return r
+
+	if dropped {
+		q.pol.dropped(d)
+	}
+	return ok
 }
 
 // Deq dequeues an element from the queue and returns it. The bool retval is false
 // if the queue is empty and true otherwise.
 func (q *SyncQ[T]) Deq() (T, bool) {
-	q.Lock()
+	q.lock()
 	a, b := q.Q.Deq()
+	if b {
+		q.notFull.wakeup()
+	}
+	q.Unlock()
+	return a, b
+}
+
+// EnqErr is like Enq but returns ErrFull if the queue is full and
+// ErrClosed if the queue is closed.
+func (q *SyncQ[T]) EnqErr(x T) error {
+	q.lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if !q.Q.put(x) {
+		return ErrFull
+	}
+	q.notEmpty.wakeup()
+	return nil
+}
+
+// DeqErr is like Deq but returns ErrEmpty if the queue is empty and
+// ErrClosed if the queue is closed and empty.
+func (q *SyncQ[T]) DeqErr() (T, error) {
+	q.lock()
+	defer q.Unlock()
+
+	x, ok := q.Q.Deq()
+	switch {
+	case ok:
+		q.notFull.wakeup()
+		return x, nil
+	case q.closed:
+		return x, ErrClosed
+	default:
+		return x, ErrEmpty
+	}
+}
+
+// blocks returns true if Enq blocks on a full queue
+func (q *SyncQ[T]) blocks() bool {
+	return q.pol.policy == Block
+}
+
+// EnqWait enqueues a new element to the queue; if the queue is full, the
+// caller is blocked until space is available or the context is cancelled.
+// It returns nil on success, ErrClosed if the queue is closed and the
+// context error otherwise.
+func (q *SyncQ[T]) EnqWait(ctx context.Context, x T) error {
+	q.lock()
+	for {
+		if q.closed {
+			q.Unlock()
+			return ErrClosed
+		}
+
+		if q.Q.put(x) {
+			q.notEmpty.wakeup()
+			q.Unlock()
+			return nil
+		}
+
+		ch := q.notFull.wait()
+		q.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		q.lock()
+	}
+}
+
+// DeqWait dequeues an element from the queue; if the queue is empty, the
+// caller is blocked until an element is available or the context is
+// cancelled. It returns ErrClosed if the queue is closed and empty, and
+// the context error if the context is done before an element is available.
+func (q *SyncQ[T]) DeqWait(ctx context.Context) (T, error) {
+	q.lock()
+	for {
+		x, ok := q.Q.Deq()
+		if ok {
+			q.notFull.wakeup()
+			q.Unlock()
+			return x, nil
+		}
+
+		if q.closed {
+			q.Unlock()
+			return x, ErrClosed
+		}
+
+		ch := q.notEmpty.wait()
+		q.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			var z T
+			return z, ctx.Err()
+		}
+		q.lock()
+	}
+}
+
+// EnqTimeout is like EnqWait but gives up after duration 'd'.
+// It returns context.DeadlineExceeded on timeout.
+func (q *SyncQ[T]) EnqTimeout(x T, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.EnqWait(ctx, x)
+}
+
+// DeqTimeout is like DeqWait but gives up after duration 'd'.
+// It returns context.DeadlineExceeded on timeout.
+func (q *SyncQ[T]) DeqTimeout(d time.Duration) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.DeqWait(ctx)
+}
+
+// PushFront inserts a new element at the head of the queue; return false
+// if the queue is full or closed and true otherwise.
+func (q *SyncQ[T]) PushFront(x T) bool {
+	q.lock()
+	r := !q.closed && q.Q.PushFront(x)
+	if r {
+		q.notEmpty.wakeup()
+	}
+	q.Unlock()
+	return r
+}
+
+// PopBack removes the newest element from the queue and returns it. The
+// bool retval is false if the queue is empty and true otherwise.
+func (q *SyncQ[T]) PopBack() (T, bool) {
+	q.lock()
+	a, b := q.Q.PopBack()
+	if b {
+		q.notFull.wakeup()
+	}
 	q.Unlock()
 	return a, b
 }
 
+// PeekFront returns the oldest element without removing it. The bool
+// retval is false if the queue is empty and true otherwise.
+func (q *SyncQ[T]) PeekFront() (T, bool) {
+	q.lock()
+	a, b := q.Q.PeekFront()
+	q.Unlock()
+	return a, b
+}
+
+// PeekBack returns the newest element without removing it. The bool
+// retval is false if the queue is empty and true otherwise.
+func (q *SyncQ[T]) PeekBack() (T, bool) {
+	q.lock()
+	a, b := q.Q.PeekBack()
+	q.Unlock()
+	return a, b
+}
+
+// At returns the i'th element from the head of the queue. The bool
+// retval is false if 'i' is out of range and true otherwise.
+func (q *SyncQ[T]) At(i int) (T, bool) {
+	q.lock()
+	a, b := q.Q.At(i)
+	q.Unlock()
+	return a, b
+}
+
+// All returns an iterator over a snapshot of the queue taken when the
+// iteration starts; the elements are returned from the oldest to the
+// newest and the queue is not modified.
+func (q *SyncQ[T]) All() iter.Seq[T] {
+	return func(yield func(T) bool) {
+		q.lock()
+		v := slices.Collect(q.Q.All())
+		q.Unlock()
+
+		for _, x := range v {
+			if !yield(x) {
+				return
+			}
+		}
+	}
+}
+
+// Drain returns an iterator that dequeues each element of the queue
+// from the oldest to the newest. Each element is dequeued under the
+// lock; the iteration ends when the queue is empty.
+func (q *SyncQ[T]) Drain() iter.Seq[T] {
+	return drain(q.Deq)
+}
+
+// EnableStats turns on the collection of runtime statistics for this
+// queue; this includes the number of times the queue lock was
+// contended. It must be called before the queue is shared between
+// go-routines; the lock is uncounted until then.
+func (q *SyncQ[T]) EnableStats() {
+	q.Q.EnableStats()
+}
+
+// syncStats marks SyncQ as a SyncStatsProvider
+func (q *SyncQ[T]) syncStats() {}
+
+// Stats returns a snapshot of the runtime statistics of this queue
+func (q *SyncQ[T]) Stats() QStats {
+	q.lock()
+	r := q.Q.Stats()
+	q.Unlock()
+	return r
+}
+
+// notify returns a channel that is closed when the queue is not
+// empty or closed; it lets a Selector wait on several queues. It
+// returns true if the queue is closed and empty.
+func (q *SyncQ[T]) notify() (<-chan struct{}, bool) {
+	q.lock()
+	defer q.Unlock()
+
+	switch {
+	case !q.Q.IsEmpty():
+		return closedch, false
+	case q.closed:
+		return nil, true
+	}
+	return q.notEmpty.wait(), false
+}
+
+// unnotify is a no-op; the waitq needs no cleanup
+func (q *SyncQ[T]) unnotify() {}
+
+// lock acquires the queue lock; it only pays for counting the
+// contention if stats are enabled.
+func (q *SyncQ[T]) lock() {
+	if q.st == nil {
+		q.Lock()
+		return
+	}
+
+	if !q.TryLock() {
+		q.Lock()
+		q.st.Contended++
+	}
+}
+
+// Close closes the queue for new elements: subsequent enqueues fail
+// and return ErrClosed where they return an error. Consumers can
+// continue to dequeue the remaining elements; once the queue is empty,
+// the error returning dequeues return ErrClosed. Close wakes up all
+// blocked producers and consumers. Closing a closed queue returns
+// ErrClosed.
+func (q *SyncQ[T]) Close() error {
+	q.lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	q.closed = true
+	q.notFull.wakeup()
+	q.notEmpty.wakeup()
+	return nil
+}
+
+// IsClosed returns true if the queue is closed
+func (q *SyncQ[T]) IsClosed() bool {
+	q.lock()
+	r := q.closed
+	q.Unlock()
+	return r
+}
+
 // IsEmpty returns true if the queue is empty and false otherwise
 func (q *SyncQ[T]) IsEmpty() bool {
-	q.Lock()
+	q.lock()
 	r := q.Q.IsEmpty()
 	q.Unlock()
 	return r
@@ -184,7 +703,7 @@ func (q *SyncQ[T]) IsEmpty() bool {
 
 // IsFull returns true if the queue is full and false otherwise
 func (q *SyncQ[T]) IsFull() bool {
-	q.Lock()
+	q.lock()
 	r := q.Q.IsFull()
 	q.Unlock()
 	return r
@@ -192,7 +711,7 @@ func (q *SyncQ[T]) IsFull() bool {
 
 // Len returns the number of elements in the queue
 func (q *SyncQ[T]) Len() int {
-	q.Lock()
+	q.lock()
 	r := q.Q.Len()
 	q.Unlock()
 	return r
@@ -200,7 +719,7 @@ func (q *SyncQ[T]) Len() int {
 
 // Size returns the capacity of the queue
 func (q *SyncQ[T]) Size() int {
-	q.Lock()
+	q.lock()
 	r := q.Q.Size()
 	q.Unlock()
 	return r
@@ -208,7 +727,7 @@ func (q *SyncQ[T]) Size() int {
 
 // String prints a string representation of the queue
 func (q *SyncQ[T]) String() string {
-	q.Lock()
+	q.lock()
 	s := q.repr("SyncQ")
 	q.Unlock()
 	return s
@@ -3,7 +3,12 @@
 package utils
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"testing"
+	"time"
 )
 
 // Basic sanity tests
@@ -12,7 +17,7 @@ func TestBasic(t *testing.T) {
 
 	var v bool
 
-	q := NewQ[int](3)
+	q := NewQ[int](4)
 
 	assert(q.IsEmpty(), "expected q to be empty")
 	assert(!q.IsFull(), "expected q to not be full")
@@ -26,13 +31,16 @@ func TestBasic(t *testing.T) {
 	v = q.Enq(30)
 	assert(v, "enq-30 failed")
 
+	v = q.Enq(40)
+	assert(v, "enq-40 failed")
+
 	assert(q.IsFull(), "expected q to be full")
 	assert(!q.IsEmpty(), "expected q to not be empty")
-	assert(q.Len() == 3, "qsize exp 3, saw %d", q.Len())
+	assert(q.Len() == 4, "qsize exp 4, saw %d", q.Len())
 
 	// Now q will be full
-	v = q.Enq(40)
-	assert(!v, "enq-4 should have failed")
+	v = q.Enq(50)
+	assert(!v, "enq-5 should have failed")
 
 	// Pull items off the queue
 
@@ -48,6 +56,10 @@ func TestBasic(t *testing.T) {
 	assert(v, "deq-2 failed")
 	assert(z == 30, "deq-2 value mismatch, exp 30, saw %d", z)
 
+	z, v = q.Deq()
+	assert(v, "deq-3 failed")
+	assert(z == 40, "deq-3 value mismatch, exp 40, saw %d", z)
+
 	assert(q.IsEmpty(), "expected q to be empty")
 
 	_, v = q.Deq()
@@ -62,7 +74,7 @@ func TestWrapAround(t *testing.T) {
 
 	q := NewQ[int](3)
 
-	assert(q.Size() == 3, "Q size exp 3, saw %d", q.Size())
+	assert(q.Size() == 4, "Q size exp 4, saw %d", q.Size())
 
 	v = q.Enq(10)
 	assert(v, "enq-10 failed")
@@ -73,9 +85,12 @@ func TestWrapAround(t *testing.T) {
 	v = q.Enq(30)
 	assert(v, "enq-30 failed")
 
+	v = q.Enq(35)
+	assert(v, "enq-35 failed")
+
 	assert(q.IsFull(), "expected q to be full")
 	assert(!q.IsEmpty(), "expected q to not be empty")
-	assert(q.Len() == 3, "qsize exp 3, saw %d", q.Len())
+	assert(q.Len() == 4, "qsize exp 4, saw %d", q.Len())
 
 	z, v := q.Deq()
 	assert(v, "deq-0 failed")
@@ -91,7 +106,14 @@ func TestWrapAround(t *testing.T) {
 	v = q.Enq(50)
 	assert(v, "enq-50 failed")
 
-	assert(q.Len() == 3, "q size mismatch, exp 3, saw %d", q.Len())
+	assert(q.Len() == 4, "q size mismatch, exp 4, saw %d", q.Len())
+	assert(q.IsFull(), "expected q to be full")
+
+	for _, exp := range []int{30, 35, 40, 50} {
+		z, v = q.Deq()
+		assert(v, "deq failed")
+		assert(z == exp, "deq value mismatch, exp %d, saw %d", exp, z)
+	}
 }
 
 // Test wrap around
@@ -102,6 +124,7 @@ func TestWithInitialData(t *testing.T) {
 		33,
 		44,
 		55,
+		66,
 	}
 
 	q := NewQFrom[int](z[:])
@@ -116,3 +139,327 @@ func TestWithInitialData(t *testing.T) {
 	}
 	assert(q.IsEmpty(), "expected q to be empty")
 }
+
+func TestCapacity(t *testing.T) {
+	assert := newAsserter(t)
+
+	for n := 1; n <= 70; n++ {
+		q := NewQ[int](n)
+		z := q.Size()
+		assert(z >= n && z&(z-1) == 0, "size %d: saw %d", n, z)
+		assert(z < 2*n, "size %d: saw %d", n, z)
+
+		for i := 0; i < z; i++ {
+			assert(q.Enq(i), "size %d: enq-%d failed", n, i)
+		}
+		assert(q.IsFull(), "size %d: expected q to be full", n)
+		assert(!q.Enq(z), "size %d: enq on full q", n)
+	}
+
+	assert(NewQ[int](1024).Size() == 1024, "size 1024: saw %d", NewQ[int](1024).Size())
+	assert(NewSyncQ[int](4).Size() == 4, "syncq size 4: saw %d", NewSyncQ[int](4).Size())
+	assert(NewSPSCQ[int](4).Size() == 4, "spscq size 4: saw %d", NewSPSCQ[int](4).Size())
+}
+
+// Test blocking enq/deq
+func TestSyncQWait(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSyncQ[int](4)
+	ctx := context.Background()
+
+	const n = 1000
+
+	// the producer can't call assert (t.Fatalf) off the test go-routine
+	errch := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := q.EnqWait(ctx, i); err != nil {
+				errch <- fmt.Errorf("enq-%d: %w", i, err)
+				return
+			}
+		}
+		errch <- nil
+	}()
+
+	for i := 0; i < n; i++ {
+		z, err := q.DeqWait(ctx)
+		assert(err == nil, "deq-%d: %s", i, err)
+		assert(z == i, "deq-%d: exp %d, saw %d", i, i, z)
+	}
+	err := <-errch
+	assert(err == nil, "producer: %s", err)
+	assert(q.IsEmpty(), "expected q to be empty")
+}
+
+// Test timeouts and cancellation of blocking enq/deq
+func TestSyncQWaitCancel(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSyncQ[int](1)
+
+	_, err := q.DeqTimeout(10 * time.Millisecond)
+	assert(errors.Is(err, context.DeadlineExceeded), "deq: exp timeout, saw %v", err)
+
+	assert(q.Enq(10), "enq-10 failed")
+	err = q.EnqTimeout(20, 10*time.Millisecond)
+	assert(errors.Is(err, context.DeadlineExceeded), "enq: exp timeout, saw %v", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = q.EnqWait(ctx, 20)
+	assert(errors.Is(err, context.Canceled), "enq: exp cancel, saw %v", err)
+
+	// a waiting producer must be woken up by a Deq
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Deq()
+	}()
+	err = q.EnqTimeout(30, 5*time.Second)
+	assert(err == nil, "enq-30: %v", err)
+
+	z, err := q.DeqTimeout(time.Second)
+	assert(err == nil, "deq: %v", err)
+	assert(z == 30, "deq: exp 30, saw %d", z)
+}
+
+// Test deque ops at both ends with wrap around
+func TestSyncQClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSyncQ[int](4)
+	assert(q.EnqErr(1) == nil, "enq-1 failed")
+	assert(q.EnqErr(2) == nil, "enq-2 failed")
+
+	assert(q.Close() == nil, "close failed")
+	assert(q.IsClosed(), "not closed")
+	assert(errors.Is(q.Close(), ErrClosed), "double close: exp ErrClosed")
+
+	assert(!q.Enq(3), "enq after close succeeded")
+	assert(!q.PushFront(3), "pushfront after close succeeded")
+	err := q.EnqErr(3)
+	assert(errors.Is(err, ErrClosed), "enq: exp ErrClosed, saw %v", err)
+	err = q.EnqWait(context.Background(), 3)
+	assert(errors.Is(err, ErrClosed), "enqwait: exp ErrClosed, saw %v", err)
+
+	// remaining elements are still delivered
+	for i := 1; i <= 2; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil, "deq-%d: %v", i, err)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+
+	_, err = q.DeqErr()
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+	_, err = q.DeqWait(context.Background())
+	assert(errors.Is(err, ErrClosed), "deqwait: exp ErrClosed, saw %v", err)
+
+	// errors on an open queue
+	q = NewSyncQ[int](1)
+	_, err = q.DeqErr()
+	assert(errors.Is(err, ErrEmpty), "deq: exp ErrEmpty, saw %v", err)
+	for q.Enq(0) {
+	}
+	err = q.EnqErr(0)
+	assert(errors.Is(err, ErrFull), "enq: exp ErrFull, saw %v", err)
+}
+
+func TestSyncQCloseWakeup(t *testing.T) {
+	assert := newAsserter(t)
+
+	// blocked consumer
+	q := NewSyncQ[int](1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+	_, err := q.DeqTimeout(5 * time.Second)
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+
+	// blocked producer
+	q = NewSyncQ[int](1)
+	for q.Enq(0) {
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+	err = q.EnqTimeout(1, 5*time.Second)
+	assert(errors.Is(err, ErrClosed), "enq: exp ErrClosed, saw %v", err)
+}
+
+func TestDeque(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewQ[int](3)
+
+	_, ok := q.PeekFront()
+	assert(!ok, "peek-front on empty q should fail")
+	_, ok = q.PeekBack()
+	assert(!ok, "peek-back on empty q should fail")
+	_, ok = q.PopBack()
+	assert(!ok, "pop-back on empty q should fail")
+	_, ok = q.At(0)
+	assert(!ok, "at-0 on empty q should fail")
+
+	// PushFront on an empty queue wraps the head below slot 0
+	assert(q.PushFront(20), "pushfront-20 failed")
+	assert(q.PushFront(10), "pushfront-10 failed")
+	assert(q.Enq(30), "enq-30 failed")
+	assert(q.Enq(40), "enq-40 failed")
+	assert(q.IsFull(), "expected q to be full")
+	assert(!q.PushFront(0), "pushfront on full q should fail")
+
+	for i, v := range []int{10, 20, 30, 40} {
+		z, ok := q.At(i)
+		assert(ok, "at-%d failed", i)
+		assert(z == v, "at-%d: exp %d, saw %d", i, v, z)
+	}
+	_, ok = q.At(4)
+	assert(!ok, "at-4 should fail")
+	_, ok = q.At(-1)
+	assert(!ok, "at-(-1) should fail")
+
+	z, ok := q.PeekFront()
+	assert(ok && z == 10, "peek-front: exp 10, saw %d", z)
+	z, ok = q.PeekBack()
+	assert(ok && z == 40, "peek-back: exp 40, saw %d", z)
+
+	z, ok = q.PopBack()
+	assert(ok && z == 40, "pop-back: exp 40, saw %d", z)
+	z, ok = q.PopBack()
+	assert(ok && z == 30, "pop-back: exp 30, saw %d", z)
+	z, ok = q.Deq()
+	assert(ok && z == 10, "deq: exp 10, saw %d", z)
+	z, ok = q.PopBack()
+	assert(ok && z == 20, "pop-back: exp 20, saw %d", z)
+	assert(q.IsEmpty(), "expected q to be empty")
+
+	// walk both ends around the ring a few times
+	for i := 0; i < 20; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+		z, ok = q.PopBack()
+		assert(ok && z == i, "pop-back: exp %d, saw %d", i, z)
+
+		assert(q.PushFront(i), "pushfront-%d failed", i)
+		z, ok = q.Deq()
+		assert(ok && z == i, "deq: exp %d, saw %d", i, z)
+
+		assert(q.PushFront(i), "pushfront-%d failed", i)
+		assert(q.Enq(i+1), "enq-%d failed", i+1)
+		z, ok = q.At(1)
+		assert(ok && z == i+1, "at-1: exp %d, saw %d", i+1, z)
+		z, ok = q.PopBack()
+		assert(ok && z == i+1, "pop-back: exp %d, saw %d", i+1, z)
+		z, ok = q.PopBack()
+		assert(ok && z == i, "pop-back: exp %d, saw %d", i, z)
+	}
+	assert(q.IsEmpty(), "expected q to be empty")
+}
+
+func TestSyncDeque(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSyncQ[int](3)
+
+	assert(q.Enq(20), "enq-20 failed")
+	assert(q.PushFront(10), "pushfront-10 failed")
+	assert(q.Enq(30), "enq-30 failed")
+	assert(q.Enq(40), "enq-40 failed")
+	assert(!q.PushFront(0), "pushfront on full q should fail")
+
+	z, ok := q.At(1)
+	assert(ok && z == 20, "at-1: exp 20, saw %d", z)
+	z, ok = q.PeekFront()
+	assert(ok && z == 10, "peek-front: exp 10, saw %d", z)
+	z, ok = q.PeekBack()
+	assert(ok && z == 40, "peek-back: exp 40, saw %d", z)
+
+	z, ok = q.PopBack()
+	assert(ok && z == 40, "pop-back: exp 40, saw %d", z)
+	z, ok = q.PopBack()
+	assert(ok && z == 30, "pop-back: exp 30, saw %d", z)
+	z, ok = q.PopBack()
+	assert(ok && z == 20, "pop-back: exp 20, saw %d", z)
+	z, ok = q.Deq()
+	assert(ok && z == 10, "deq: exp 10, saw %d", z)
+	assert(q.IsEmpty(), "expected q to be empty")
+
+	// PushFront must wake up blocked consumers
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.PushFront(40)
+	}()
+	z, err := q.DeqTimeout(5 * time.Second)
+	assert(err == nil, "deq: %v", err)
+	assert(z == 40, "deq: exp 40, saw %d", z)
+}
+
+func TestIter(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewQ[int](8)
+
+	v := slices.Collect(q.All())
+	assert(len(v) == 0, "all: exp empty, saw %v", v)
+
+	// make the contents wrap around
+	for i := 0; i < 5; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	for i := 0; i < 4; i++ {
+		q.Deq()
+	}
+	for i := 5; i < 10; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	exp := []int{4, 5, 6, 7, 8, 9}
+
+	v = slices.Collect(q.All())
+	assert(slices.Equal(v, exp), "all: exp %v, saw %v", exp, v)
+	assert(q.Len() == len(exp), "len: exp %d, saw %d", len(exp), q.Len())
+
+	// stop early; the rest must remain in the queue
+	var n int
+	for x := range q.Drain() {
+		assert(x == exp[n], "drain: exp %d, saw %d", exp[n], x)
+		if n++; n == 2 {
+			break
+		}
+	}
+	assert(q.Len() == len(exp)-2, "len: exp %d, saw %d", len(exp)-2, q.Len())
+
+	v = slices.Collect(q.Drain())
+	assert(slices.Equal(v, exp[2:]), "drain: exp %v, saw %v", exp[2:], v)
+	assert(q.IsEmpty(), "expected q to be empty")
+}
+
+func TestSyncIter(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSyncQ[int](8)
+	for i := 1; i <= 3; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	all := q.All()
+
+	v := slices.Collect(all)
+	assert(slices.Equal(v, []int{1, 2, 3}), "all: saw %v", v)
+
+	// the snapshot is taken when the iteration starts
+	q.Deq()
+	q.Enq(4)
+	v = slices.Collect(all)
+	assert(slices.Equal(v, []int{2, 3, 4}), "all: saw %v", v)
+
+	// modifying the queue during iteration is safe
+	for x := range q.All() {
+		q.Enq(x * 10)
+	}
+	v = slices.Collect(q.Drain())
+	assert(slices.Equal(v, []int{2, 3, 4, 20, 30, 40}), "drain: saw %v", v)
+	assert(q.IsEmpty(), "expected q to be empty")
+}
@@ -0,0 +1,281 @@
+// qcodec.go - serialization of Q and SyncQ contents
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Notes:
+//   - a queue is serialized as its capacity and its elements in FIFO
+//     order; the rd/wr counters, the policy and the stats are not
+//     part of the image.
+//   - the binary form is a version byte followed by the gob encoding
+//     of the image; GobEncode uses the binary form.
+//   - the JSON form is {"cap": N, "elems": [...]}.
+//   - decoding replaces the contents and capacity of the receiver and
+//     keeps its policy and stats. Images are untrusted input: their
+//     capacity is only accepted up to qImageMaxCap or the capacity of
+//     the receiver, whichever is larger. Encoding has no limit; a big
+//     queue is restored into a receiver made with NewQ(n) of at least
+//     its capacity.
+//   - DynQ keeps its bounds: the decoded capacity is clamped to the
+//     receiver's min and max sizes. Ring and SyncRing have no codec.
+
+// version of the binary image
+const qImageVersion = 1
+
+// largest capacity we'll accept when decoding into a smaller queue;
+// images are untrusted input and the capacity is allocated up front.
+const qImageMaxCap = 1 << 24
+
+// ErrBadImage is returned when decoding a malformed queue image
+var ErrBadImage = errors.New("queue: malformed image")
+
+// qImage is the serialized form of a queue
+type qImage[T any] struct {
+	Cap   int `json:"cap"`
+	Elems []T `json:"elems"`
+}
+
+// image returns the contents of the queue in FIFO order
+func (q *Q[T]) image() qImage[T] {
+	return qImage[T]{
+		Cap:   len(q.q),
+		Elems: slices.Collect(q.All()),
+	}
+}
+
+// check validates an image; capacities up to 'limit' or qImageMaxCap
+// are accepted.
+func (im *qImage[T]) check(limit int) error {
+	z := im.Cap
+	if z <= 0 || z > max(limit, qImageMaxCap) || z&(z-1) != 0 {
+		return fmt.Errorf("%w: capacity %d", ErrBadImage, z)
+	}
+	if len(im.Elems) > z {
+		return fmt.Errorf("%w: %d elements exceed capacity %d", ErrBadImage, len(im.Elems), z)
+	}
+	return nil
+}
+
+// restore replaces the contents of the queue with 'im'
+func (q *Q[T]) restore(im *qImage[T]) error {
+	if err := im.check(len(q.q)); err != nil {
+		return err
+	}
+	q.load(im.Elems, im.Cap)
+	return nil
+}
+
+// load makes the queue hold 'v' with capacity 'z'
+func (q *Q[T]) load(v []T, z int) {
+	q.init(z)
+	n := copy(q.q, v)
+	q.wr = uint64(n) //#nosec G115 -- 64 bit platforms
+}
+
+// restore replaces the contents of the queue with 'im'; the capacity
+// is clamped to the bounds of the queue.
+func (q *DynQ[T]) restore(im *qImage[T]) error {
+	limit := len(q.q)
+	if q.max > 0 {
+		limit = int(q.max) //#nosec G115 -- bounded by a slice length
+	}
+	if err := im.check(limit); err != nil {
+		return err
+	}
+
+	z := uint64(im.Cap) //#nosec G115 -- checked above
+	if q.min == 0 {
+		// a zero value DynQ starts at the image size
+		q.min = z
+	}
+	z = max(z, q.min)
+	if q.max > 0 {
+		z = min(z, q.max)
+	}
+	if n := len(im.Elems); uint64(n) > z {
+		return fmt.Errorf("%w: %d elements exceed max size %d", ErrBadImage, n, z)
+	}
+
+	q.load(im.Elems, int(z)) //#nosec G115 -- bounded by the image capacity
+	return nil
+}
+
+func marshalImage[T any](im qImage[T]) ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteByte(qImageVersion)
+	if err := gob.NewEncoder(&b).Encode(&im); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func unmarshalImage[T any](b []byte) (qImage[T], error) {
+	var im qImage[T]
+
+	if len(b) == 0 {
+		return im, fmt.Errorf("%w: empty", ErrBadImage)
+	}
+	if b[0] != qImageVersion {
+		return im, fmt.Errorf("%w: unknown version %d", ErrBadImage, b[0])
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b[1:])).Decode(&im); err != nil {
+		return im, fmt.Errorf("%w: %w", ErrBadImage, err)
+	}
+	return im, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler; the elements are
+// encoded with encoding/gob in FIFO order.
+func (q *Q[T]) MarshalBinary() ([]byte, error) {
+	return marshalImage(q.image())
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler; it replaces
+// the contents and capacity of the queue with the decoded image. An
+// image with a capacity over 16M elements is only accepted if the
+// queue is at least as big.
+func (q *Q[T]) UnmarshalBinary(b []byte) error {
+	im, err := unmarshalImage[T](b)
+	if err != nil {
+		return err
+	}
+	return q.restore(&im)
+}
+
+// GobEncode implements gob.GobEncoder
+func (q *Q[T]) GobEncode() ([]byte, error) {
+	return q.MarshalBinary()
+}
+
+// GobDecode implements gob.GobDecoder
+func (q *Q[T]) GobDecode(b []byte) error {
+	return q.UnmarshalBinary(b)
+}
+
+// MarshalJSON implements json.Marshaler; T must be JSON-able.
+func (q *Q[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.image())
+}
+
+// UnmarshalJSON implements json.Unmarshaler; it replaces the contents
+// and capacity of the queue with the decoded image.
+func (q *Q[T]) UnmarshalJSON(b []byte) error {
+	var im qImage[T]
+
+	if err := json.Unmarshal(b, &im); err != nil {
+		return err
+	}
+	return q.restore(&im)
+}
+
+// image returns a consistent snapshot of the queue contents
+func (q *SyncQ[T]) image() qImage[T] {
+	q.lock()
+	defer q.Unlock()
+
+	return q.Q.image()
+}
+
+// restore replaces the contents of the queue and wakes up the waiters;
+// the closed state of the queue is unchanged.
+func (q *SyncQ[T]) restore(im *qImage[T]) error {
+	q.lock()
+	defer q.Unlock()
+
+	if err := q.Q.restore(im); err != nil {
+		return err
+	}
+	q.notFull.wakeup()
+	if !q.Q.IsEmpty() {
+		q.notEmpty.wakeup()
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler; the elements are
+// encoded with encoding/gob in FIFO order.
+func (q *SyncQ[T]) MarshalBinary() ([]byte, error) {
+	return marshalImage(q.image())
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler; it replaces
+// the contents and capacity of the queue with the decoded image.
+func (q *SyncQ[T]) UnmarshalBinary(b []byte) error {
+	im, err := unmarshalImage[T](b)
+	if err != nil {
+		return err
+	}
+	return q.restore(&im)
+}
+
+// GobEncode implements gob.GobEncoder
+func (q *SyncQ[T]) GobEncode() ([]byte, error) {
+	return q.MarshalBinary()
+}
+
+// GobDecode implements gob.GobDecoder
+func (q *SyncQ[T]) GobDecode(b []byte) error {
+	return q.UnmarshalBinary(b)
+}
+
+// MarshalJSON implements json.Marshaler; T must be JSON-able.
+func (q *SyncQ[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.image())
+}
+
+// UnmarshalJSON implements json.Unmarshaler; it replaces the contents
+// and capacity of the queue with the decoded image.
+func (q *SyncQ[T]) UnmarshalJSON(b []byte) error {
+	var im qImage[T]
+
+	if err := json.Unmarshal(b, &im); err != nil {
+		return err
+	}
+	return q.restore(&im)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler; it replaces
+// the contents of the queue with the decoded image and keeps the
+// bounds of the queue.
+func (q *DynQ[T]) UnmarshalBinary(b []byte) error {
+	im, err := unmarshalImage[T](b)
+	if err != nil {
+		return err
+	}
+	return q.restore(&im)
+}
+
+// GobDecode implements gob.GobDecoder
+func (q *DynQ[T]) GobDecode(b []byte) error {
+	return q.UnmarshalBinary(b)
+}
+
+// UnmarshalJSON implements json.Unmarshaler; it replaces the contents
+// of the queue with the decoded image and keeps the bounds of the
+// queue.
+func (q *DynQ[T]) UnmarshalJSON(b []byte) error {
+	var im qImage[T]
+
+	if err := json.Unmarshal(b, &im); err != nil {
+		return err
+	}
+	return q.restore(&im)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,275 @@
+// qcodec_test.go - tests for Q and SyncQ serialization
+
+package utils
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = &Q[int]{}
+	_ encoding.BinaryUnmarshaler = &Q[int]{}
+	_ gob.GobEncoder             = &SyncQ[int]{}
+	_ gob.GobDecoder             = &SyncQ[int]{}
+	_ json.Marshaler             = &SyncQ[int]{}
+	_ json.Unmarshaler           = &SyncQ[int]{}
+)
+
+// wrapped returns a queue of capacity 8 whose elements wrap around
+// the end of the backing slice: 5, 6, .. 10
+func wrapped() *Q[int] {
+	q := NewQ[int](8)
+	for i := 0; i < 11; i++ {
+		q.Enq(i)
+		if i < 5 {
+			q.Deq()
+		}
+	}
+	return q
+}
+
+func TestQCodecBinary(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := wrapped()
+	exp := slices.Collect(q.All())
+	assert(q.rd&q.mask > q.wr&q.mask, "queue doesn't wrap: %s", q)
+
+	b, err := q.MarshalBinary()
+	assert(err == nil, "marshal: %v", err)
+
+	var r Q[int]
+	err = r.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(r.Size() == q.Size(), "size: exp %d, saw %d", q.Size(), r.Size())
+	assert(slices.Equal(slices.Collect(r.All()), exp), "elems: exp %v, saw %v", exp, slices.Collect(r.All()))
+
+	// the decoded queue is fully usable
+	for r.Enq(100) {
+	}
+	assert(r.Len() == r.Size(), "len: exp %d, saw %d", r.Size(), r.Len())
+	x, ok := r.Deq()
+	assert(ok && x == exp[0], "deq: exp %d, saw %d", exp[0], x)
+
+	// decoding replaces the existing contents and capacity
+	s := NewQFrom([]int{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	err = s.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(s.Size() == 8, "size: exp 8, saw %d", s.Size())
+	assert(slices.Equal(slices.Collect(s.All()), exp), "elems: exp %v, saw %v", exp, slices.Collect(s.All()))
+
+	// an empty queue
+	b, err = NewQ[string](4).MarshalBinary()
+	assert(err == nil, "marshal: %v", err)
+	var e Q[string]
+	err = e.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(e.Size() == 4 && e.IsEmpty(), "empty: saw %s", &e)
+}
+
+func TestQCodecGob(t *testing.T) {
+	assert := newAsserter(t)
+
+	type state struct {
+		Name string
+		Q    *Q[int]
+		S    *SyncQ[string]
+	}
+
+	in := state{
+		Name: "ckpt",
+		Q:    wrapped(),
+		S:    NewSyncQFrom([]string{"a", "b", "c"}),
+	}
+
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(&in)
+	assert(err == nil, "encode: %v", err)
+
+	var out state
+	err = gob.NewDecoder(&b).Decode(&out)
+	assert(err == nil, "decode: %v", err)
+	assert(out.Name == in.Name, "name: exp %s, saw %s", in.Name, out.Name)
+	assert(out.Q.Size() == in.Q.Size(), "size: exp %d, saw %d", in.Q.Size(), out.Q.Size())
+	assert(slices.Equal(slices.Collect(out.Q.All()), slices.Collect(in.Q.All())),
+		"q: exp %v, saw %v", slices.Collect(in.Q.All()), slices.Collect(out.Q.All()))
+	assert(out.S.Size() == 4, "size: exp 4, saw %d", out.S.Size())
+	assert(slices.Equal(slices.Collect(out.S.All()), []string{"a", "b", "c"}),
+		"syncq: saw %v", slices.Collect(out.S.All()))
+}
+
+func TestQCodecJSON(t *testing.T) {
+	assert := newAsserter(t)
+
+	type point struct {
+		X, Y int
+	}
+
+	q := NewSyncQ[point](4)
+	q.Enq(point{1, 2})
+	q.Enq(point{3, 4})
+	q.Deq()
+	q.Enq(point{5, 6})
+
+	b, err := json.Marshal(q)
+	assert(err == nil, "marshal: %v", err)
+	exp := `{"cap":4,"elems":[{"X":3,"Y":4},{"X":5,"Y":6}]}`
+	assert(string(b) == exp, "json: exp %s, saw %s", exp, b)
+
+	r := NewSyncQ[point](16)
+	err = json.Unmarshal(b, r)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(r.Size() == 4 && r.Len() == 2, "saw %s", r)
+	x, ok := r.Deq()
+	assert(ok && x == point{3, 4}, "deq: saw %v", x)
+
+	var e Q[int]
+	err = json.Unmarshal([]byte(`{"cap":2,"elems":[]}`), &e)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(e.Size() == 2 && e.IsEmpty(), "empty: saw %s", &e)
+}
+
+func TestQCodecErrors(t *testing.T) {
+	assert := newAsserter(t)
+
+	bad := []string{
+		`{"cap":0,"elems":[]}`,
+		`{"cap":3,"elems":[1]}`,
+		`{"cap":-4,"elems":[]}`,
+		`{"cap":2,"elems":[1,2,3]}`,
+		`{"cap":8589934592,"elems":[]}`,
+		`{"cap":33554432,"elems":[]}`,
+	}
+	for _, s := range bad {
+		q := NewQFrom([]int{1, 2})
+		err := json.Unmarshal([]byte(s), q)
+		assert(errors.Is(err, ErrBadImage), "%s: exp ErrBadImage, saw %v", s, err)
+		assert(q.Len() == 2 && q.Size() == 2, "%s: queue modified: %s", s, q)
+	}
+
+	b, err := NewQFrom([]int{1, 2}).MarshalBinary()
+	assert(err == nil, "marshal: %v", err)
+
+	// an oversized capacity is rejected before it is allocated
+	big, err := marshalImage(qImage[int]{Cap: 1 << 32})
+	assert(err == nil, "marshal: %v", err)
+	var bq Q[int]
+	err = bq.UnmarshalBinary(big)
+	assert(errors.Is(err, ErrBadImage), "oversized: exp ErrBadImage, saw %v", err)
+	err = json.Unmarshal([]byte(`{"cap":4294967296,"elems":[]}`), &bq)
+	assert(errors.Is(err, ErrBadImage), "oversized json: exp ErrBadImage, saw %v", err)
+	assert(bq.Size() == 0, "oversized: queue allocated %d slots", bq.Size())
+
+	var q SyncQ[int]
+	err = q.UnmarshalBinary(nil)
+	assert(errors.Is(err, ErrBadImage), "nil: exp ErrBadImage, saw %v", err)
+
+	v := slices.Clone(b)
+	v[0]++
+	err = q.UnmarshalBinary(v)
+	assert(errors.Is(err, ErrBadImage), "version: exp ErrBadImage, saw %v", err)
+
+	err = q.UnmarshalBinary(b[:len(b)-2])
+	assert(errors.Is(err, ErrBadImage), "truncated: exp ErrBadImage, saw %v", err)
+
+	err = q.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(slices.Equal(slices.Collect(q.All()), []int{1, 2}), "saw %s", &q)
+}
+
+func TestQCodecLimit(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a queue at the limit round trips
+	q := NewQ[byte](qImageMaxCap)
+	for i := 0; i < 3; i++ {
+		q.Enq(byte(i))
+	}
+
+	b, err := q.MarshalBinary()
+	assert(err == nil, "marshal: %v", err)
+	var bq Q[byte]
+	err = bq.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(bq.Size() == qImageMaxCap, "unmarshal: exp cap %d, saw %d", qImageMaxCap, bq.Size())
+	assert(slices.Equal(slices.Collect(bq.All()), []byte{0, 1, 2}), "unmarshal: saw %s", &bq)
+
+	j, err := json.Marshal(q)
+	assert(err == nil, "json marshal: %v", err)
+	var jq Q[byte]
+	err = json.Unmarshal(j, &jq)
+	assert(err == nil, "json unmarshal: %v", err)
+	assert(jq.Size() == qImageMaxCap && jq.Len() == 3, "json unmarshal: saw %s", &jq)
+
+	// a bigger queue is encoded; it only decodes into a queue that
+	// is at least as big.
+	big := NewSyncQ[byte](2 * qImageMaxCap)
+	big.Enq(1)
+	b, err = big.MarshalBinary()
+	assert(err == nil, "marshal: %v", err)
+	j, err = json.Marshal(big)
+	assert(err == nil, "json marshal: %v", err)
+
+	var zq SyncQ[byte]
+	err = zq.UnmarshalBinary(b)
+	assert(errors.Is(err, ErrBadImage), "unmarshal: exp ErrBadImage, saw %v", err)
+	assert(zq.Size() == 0, "unmarshal: queue allocated %d slots", zq.Size())
+
+	bq2 := NewSyncQ[byte](2 * qImageMaxCap)
+	err = bq2.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(bq2.Size() == big.Size() && bq2.Len() == 1, "unmarshal: saw %s", bq2)
+	err = json.Unmarshal(j, bq2)
+	assert(err == nil, "json unmarshal: %v", err)
+	assert(bq2.Size() == big.Size() && bq2.Len() == 1, "json unmarshal: saw %s", bq2)
+}
+
+func TestQCodecDynQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	src := NewQ[int](32)
+	for i := 0; i < 6; i++ {
+		src.Enq(i)
+	}
+	b, err := src.MarshalBinary()
+	assert(err == nil, "marshal: %v", err)
+	j, err := json.Marshal(src)
+	assert(err == nil, "json marshal: %v", err)
+
+	// the capacity is clamped to the max size and the bounds stay
+	q := NewDynQ[int](4, WithMaxSize(8))
+	err = q.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(q.Size() == 8 && q.Len() == 6, "unmarshal: saw %s", q)
+	assert(q.Enq(6) && q.Enq(7), "enq failed")
+	assert(!q.Enq(8), "enq past max size")
+
+	// and to the min size
+	q = NewDynQ[int](64)
+	err = json.Unmarshal(j, q)
+	assert(err == nil, "json unmarshal: %v", err)
+	assert(q.Size() == 64 && q.Len() == 6, "json unmarshal: saw %s", q)
+	assert(slices.Equal(slices.Collect(q.All()), []int{0, 1, 2, 3, 4, 5}), "saw %s", q)
+
+	// the elements must fit in the max size
+	q = NewDynQ[int](2, WithMaxSize(4))
+	err = q.UnmarshalBinary(b)
+	assert(errors.Is(err, ErrBadImage), "too many: exp ErrBadImage, saw %v", err)
+	assert(q.Size() == 2 && q.IsEmpty(), "too many: queue modified: %s", q)
+
+	// a zero value DynQ grows from the image size
+	var zq DynQ[int]
+	err = zq.GobDecode(b)
+	assert(err == nil, "gob decode: %v", err)
+	assert(zq.Size() == 32 && zq.Len() == 6, "gob decode: saw %s", &zq)
+	for i := 0; i < 40; i++ {
+		assert(zq.Enq(i), "enq-%d failed", i)
+	}
+	assert(zq.Size() == 64, "grow: exp 64, saw %d", zq.Size())
+}
@@ -10,48 +10,126 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"iter"
 	"math/bits"
 )
 
+var (
+	// ErrClosed is returned when operating on a closed queue
+	ErrClosed = errors.New("queue closed")
+
+	// ErrFull is returned when enqueuing to a full queue
+	ErrFull = errors.New("queue full")
+
+	// ErrEmpty is returned when dequeuing from an empty queue
+	ErrEmpty = errors.New("queue empty")
+)
+
+// Queue is the common interface of the bounded FIFO queues in this
+// package: Q, SyncQ, SPSCQ, MPSCQ and MPMCQ. Whether the methods are
+// safe for concurrent use depends on the implementation. Package
+// queuetest has conformance and linearizability tests for any
+// implementation of Queue.
+type Queue[T any] interface {
+	Enqueuer[T]
+	Dequeuer[T]
+
+	// Len returns the number of elements in the queue
+	Len() int
+
+	// Size returns the capacity of the queue
+	Size() int
+
+	// IsEmpty returns true if the queue is empty
+	IsEmpty() bool
+
+	// IsFull returns true if the queue is full
+	IsFull() bool
+
+	// Flush empties the queue
+	Flush()
+}
+
+// nextpow2 returns the smallest power-of-2 that is >= z
 func nextpow2[T ~uint | ~uint16 | ~uint32 | ~uint64](z T) T {
-	i := bits.LeadingZeros64(uint64(z))
+	if z <= 1 {
+		return 1
+	}
+
+	i := bits.LeadingZeros64(uint64(z) - 1)
 	v := uint64(1) << (64 - i)
 	return T(v)
 }
 
-func qlen(rd, wr, mask uint64) int {
-	switch {
-	case rd == wr:
-		return 0
-	case rd < wr:
-		return int(wr - rd) //#nosec G115 ; condition check prevents overflow
-	default: // wrapped around
-		z := (mask + 1) - rd
-		return int(z + wr) //#nosec G115 ; condition check prevents overflow
-	}
+// The ring queues use free running rd/wr counters that are masked
+// on access; the queue holds the elements [rd, wr) and can use all
+// of its 'sz' slots.
+
+func qlen(rd, wr uint64) int {
+	return int(wr - rd) //#nosec G115 -- bounded by the queue size
 }
 
-func qempty(rd, wr, _ uint64) bool {
+func qempty(rd, wr uint64) bool {
 	return rd == wr
 }
 
-func qfull(rd, wr, mask uint64) bool {
-	return rd == ((1 + wr) & mask)
+func qfull(rd, wr, sz uint64) bool {
+	return wr-rd >= sz
 }
 
-func qrepr(rd, wr, mask uint64) string {
-	full := qfull(rd, wr, mask)
-	empty := qempty(rd, wr, mask)
-	n := qlen(rd, wr, mask)
-
+func qrepr(rd, wr, sz uint64) string {
 	var p string
-	if full {
+	if qfull(rd, wr, sz) {
 		p = "[FULL] "
-	} else if empty {
+	} else if qempty(rd, wr) {
 		p = "[EMPTY] "
 	}
 
 	return fmt.Sprintf("%scap=%d len=%d wr=%d rd=%d",
-		p, mask, n, wr, rd)
+		p, sz, qlen(rd, wr), wr, rd)
+}
+
+// drain returns an iterator that calls 'deq' until the queue is empty
+// or the caller stops the iteration.
+func drain[T any](deq func() (T, bool)) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for {
+			x, ok := deq()
+			if !ok || !yield(x) {
+				return
+			}
+		}
+	}
+}
+
+// closedch is a channel that is always ready
+var closedch = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// waitq is a condition variable that can be waited on together with
+// a context. Callers must hold the lock that protects the waitq for
+// both wait() and wakeup().
+type waitq struct {
+	ch chan struct{}
+}
+
+// wait returns a channel that will be closed on the next wakeup
+func (w *waitq) wait() <-chan struct{} {
+	if w.ch == nil {
+		w.ch = make(chan struct{})
+	}
+	return w.ch
+}
+
+// wakeup wakes up all current waiters
+func (w *waitq) wakeup() {
+	if w.ch != nil {
+		close(w.ch)
+		w.ch = nil
+	}
 }
@@ -0,0 +1,56 @@
+// queue_test.go - conformance and linearizability tests for Queue[T]
+
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/opencoff/go-utils"
+	"github.com/opencoff/go-utils/queuetest"
+)
+
+var (
+	_ utils.Queue[int] = &utils.Q[int]{}
+	_ utils.Queue[int] = &utils.SyncQ[int]{}
+	_ utils.Queue[int] = &utils.SPSCQ[int]{}
+	_ utils.Queue[int] = &utils.MPSCQ[int]{}
+	_ utils.Queue[int] = &utils.MPMCQ[int]{}
+)
+
+func TestQueueConformance(t *testing.T) {
+	t.Run("Q", func(t *testing.T) {
+		queuetest.Conformance(t, func(n int) utils.Queue[int] { return utils.NewQ[int](n) })
+	})
+	t.Run("SyncQ", func(t *testing.T) {
+		queuetest.Conformance(t, func(n int) utils.Queue[int] { return utils.NewSyncQ[int](n) })
+	})
+	t.Run("SPSCQ", func(t *testing.T) {
+		queuetest.Conformance(t, func(n int) utils.Queue[int] { return utils.NewSPSCQ[int](n) })
+	})
+	t.Run("MPSCQ", func(t *testing.T) {
+		queuetest.Conformance(t, func(n int) utils.Queue[int] { return utils.NewMPSCQ[int](n) })
+	})
+	t.Run("MPMCQ", func(t *testing.T) {
+		queuetest.Conformance(t, func(n int) utils.Queue[int] { return utils.NewMPMCQ[int](n) })
+	})
+}
+
+func TestQueueLinearizable(t *testing.T) {
+	t.Run("SyncQ", func(t *testing.T) {
+		// any go-routine can enq or deq
+		queuetest.Linearizable(t, func(n int) utils.Queue[int] { return utils.NewSyncQ[int](n) }, 4, nil)
+	})
+	t.Run("SPSCQ", func(t *testing.T) {
+		// go-routine 0 is the producer and 1 is the consumer
+		spsc := func(g int) bool { return g == 0 }
+		queuetest.Linearizable(t, func(n int) utils.Queue[int] { return utils.NewSPSCQ[int](n) }, 2, spsc)
+	})
+	t.Run("MPSCQ", func(t *testing.T) {
+		// go-routines 0-2 are producers and 3 is the consumer
+		mpsc := func(g int) bool { return g < 3 }
+		queuetest.Linearizable(t, func(n int) utils.Queue[int] { return utils.NewMPSCQ[int](n) }, 4, mpsc)
+	})
+	t.Run("MPMCQ", func(t *testing.T) {
+		queuetest.Linearizable(t, func(n int) utils.Queue[int] { return utils.NewMPMCQ[int](n) }, 4, nil)
+	})
+}
@@ -0,0 +1,323 @@
+// queuetest.go - conformance and linearizability tests for queues
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package queuetest implements tests for implementations of
+// utils.Queue: a conformance suite for the sequential behavior and a
+// linearizability checker for the concurrent queues. A new queue
+// implementation gets these tests by calling Conformance and
+// Linearizable from its own tests.
+package queuetest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/opencoff/go-utils"
+)
+
+// Factory returns a new, empty queue that holds (at least) 'n'
+// elements.
+type Factory func(n int) utils.Queue[int]
+
+// Conformance runs the conformance tests for a Queue implementation:
+// capacity, wraparound, Flush and the String() output. The queue must
+// implement fmt.Stringer. The tests only use one go-routine.
+func Conformance(t *testing.T, mk Factory) {
+	t.Run("Capacity", func(t *testing.T) { testCapacity(t, mk) })
+	t.Run("WrapAround", func(t *testing.T) { testWrapAround(t, mk) })
+	t.Run("Flush", func(t *testing.T) { testFlush(t, mk) })
+	t.Run("String", func(t *testing.T) { testString(t, mk) })
+}
+
+func testCapacity(t *testing.T, mk Factory) {
+	assert := newAsserter(t)
+
+	for _, n := range []int{1, 2, 3, 4, 7, 8, 9, 100, 1024} {
+		q := mk(n)
+		z := q.Size()
+		assert(z >= n, "size %d: saw %d", n, z)
+		assert(q.IsEmpty() && !q.IsFull(), "size %d: expected q to be empty", n)
+		assert(q.Len() == 0, "size %d: len exp 0, saw %d", n, q.Len())
+
+		for i := 0; i < z; i++ {
+			assert(q.Enq(i), "size %d: enq-%d failed", n, i)
+			assert(q.Len() == i+1, "size %d: len exp %d, saw %d", n, i+1, q.Len())
+		}
+		assert(q.IsFull() && !q.IsEmpty(), "size %d: expected q to be full", n)
+		assert(!q.Enq(z), "size %d: enq on full q", n)
+
+		for i := 0; i < z; i++ {
+			x, ok := q.Deq()
+			assert(ok && x == i, "size %d: deq exp %d, saw %d", n, i, x)
+		}
+		_, ok := q.Deq()
+		assert(!ok, "size %d: deq on empty q", n)
+		assert(q.IsEmpty(), "size %d: expected q to be empty", n)
+	}
+}
+
+func testWrapAround(t *testing.T, mk Factory) {
+	assert := newAsserter(t)
+
+	q := mk(8)
+	z := q.Size()
+
+	// keep a varying number of elements in flight for several laps
+	var wr, rd int
+	for i := 0; i < 10*z; i++ {
+		k := 1 + i%z
+		for j := 0; j < k && q.Enq(wr); j++ {
+			wr++
+		}
+		for j := 0; j < k/2+1; j++ {
+			x, ok := q.Deq()
+			if !ok {
+				break
+			}
+			assert(x == rd, "deq: exp %d, saw %d", rd, x)
+			rd++
+		}
+		assert(q.Len() == wr-rd, "len: exp %d, saw %d", wr-rd, q.Len())
+	}
+	assert(wr > 5*z, "too few elements: %d", wr)
+}
+
+func testFlush(t *testing.T, mk Factory) {
+	assert := newAsserter(t)
+
+	q := mk(8)
+	z := q.Size()
+
+	q.Flush()
+	assert(q.IsEmpty(), "expected q to be empty")
+
+	for i := 0; i < z+z/2; i++ {
+		q.Enq(i)
+		if i%2 == 0 {
+			q.Deq()
+		}
+	}
+	q.Flush()
+	assert(q.IsEmpty(), "expected q to be empty after flush")
+	assert(q.Len() == 0, "len: exp 0, saw %d", q.Len())
+	_, ok := q.Deq()
+	assert(!ok, "deq after flush")
+
+	// the entire capacity is usable after a flush
+	for i := 0; i < z; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+	assert(q.IsFull(), "expected q to be full")
+	x, ok := q.Deq()
+	assert(ok && x == 0, "deq: exp 0, saw %d", x)
+}
+
+func testString(t *testing.T, mk Factory) {
+	assert := newAsserter(t)
+
+	q := mk(4)
+	sq, ok := q.(fmt.Stringer)
+	assert(ok, "%T is not a fmt.Stringer", q)
+
+	has := func(sub string) {
+		s := sq.String()
+		assert(strings.Contains(s, sub), "string: exp %q in %q", sub, s)
+	}
+
+	cs := fmt.Sprintf("cap=%d ", q.Size())
+	has(cs)
+	has("[EMPTY]")
+	has("len=0 ")
+
+	q.Enq(1)
+	has("len=1 ")
+
+	for q.Enq(2) {
+	}
+	has("[FULL]")
+	has(fmt.Sprintf("len=%d ", q.Size()))
+	has(cs)
+}
+
+// Linearizable runs 'ng' go-routines that do a random mix of Enq and
+// Deq on a small queue made by 'mk' and checks that every resulting
+// history is linearizable with respect to a bounded FIFO queue. If
+// 'prod' is not nil, go-routine 'g' only enqueues if prod(g) is true
+// and only dequeues otherwise; this is for queues with a single
+// producer or consumer.
+func Linearizable(t *testing.T, mk Factory, ng int, prod func(g int) bool) {
+	const rounds = 200
+	const nops = 8
+
+	for r := 0; r < rounds; r++ {
+		q := mk(2)
+		h := runHistory(q, ng, nops, prod)
+		if !linearizable(h, q.Size()) {
+			t.Fatalf("round %d: history is not linearizable:\n%s", r, h)
+		}
+	}
+}
+
+// linOp is a completed queue operation; 'call' and 'ret' are logical
+// timestamps taken before and after the operation.
+type linOp struct {
+	call, ret uint64
+	enq       bool
+	v         int
+	ok        bool
+}
+
+type history []linOp
+
+func (h history) String() string {
+	var b strings.Builder
+	for i, o := range h {
+		nm := "deq"
+		if o.enq {
+			nm = "enq"
+		}
+		fmt.Fprintf(&b, "  %2d: [%3d, %3d] %s %d %v\n", i, o.call, o.ret, nm, o.v, o.ok)
+	}
+	return b.String()
+}
+
+func runHistory(q utils.Queue[int], ng, nops int, prod func(g int) bool) history {
+	var clk atomic.Uint64
+	var wg sync.WaitGroup
+
+	ops := make([][]linOp, ng)
+	wg.Add(ng)
+	for g := 0; g < ng; g++ {
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < nops; i++ {
+				enq := rand.IntN(2) == 0
+				if prod != nil {
+					enq = prod(g)
+				}
+
+				var o linOp
+				o.enq = enq
+				o.call = clk.Add(1)
+				if enq {
+					// values are unique across all go-routines
+					o.v = g*nops + i
+					o.ok = q.Enq(o.v)
+				} else {
+					o.v, o.ok = q.Deq()
+				}
+				o.ret = clk.Add(1)
+
+				ops[g] = append(ops[g], o)
+				if i%2 == 0 {
+					runtime.Gosched()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var h history
+	for _, v := range ops {
+		h = append(h, v...)
+	}
+	return h
+}
+
+// linearizable returns true if the history 'h' can be explained by a
+// sequential FIFO queue of capacity 'sz'. This is a depth first
+// search over the possible linearizations (Wing & Gong) with the
+// visited states memoized; 'h' must have at most 64 operations.
+func linearizable(h history, sz int) bool {
+	if len(h) > 64 {
+		panic("linearizable: history too long")
+	}
+
+	seen := make(map[string]bool)
+	all := uint64(1)<<len(h) - 1
+
+	var dfs func(done uint64, q []int) bool
+	dfs = func(done uint64, q []int) bool {
+		if done == all {
+			return true
+		}
+
+		key := fmt.Sprint(done, q)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+
+		// an op can be linearized next only if it was called before
+		// every pending op returned.
+		minret := ^uint64(0)
+		for i, o := range h {
+			if done&(1<<i) == 0 {
+				minret = min(minret, o.ret)
+			}
+		}
+
+		for i, o := range h {
+			if done&(1<<i) != 0 || o.call > minret {
+				continue
+			}
+
+			next, ok := applyOp(q, sz, o)
+			if ok && dfs(done|(1<<i), next) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return dfs(0, nil)
+}
+
+// applyOp applies 'o' to the sequential queue 'q' and returns the new
+// queue and true if the result of 'o' matches the sequential result.
+func applyOp(q []int, sz int, o linOp) ([]int, bool) {
+	switch {
+	case o.enq && o.ok:
+		if len(q) == sz {
+			return nil, false
+		}
+		return append(q[:len(q):len(q)], o.v), true
+
+	case o.enq:
+		return q, len(q) == sz
+
+	case o.ok:
+		if len(q) == 0 || q[0] != o.v {
+			return nil, false
+		}
+		return q[1:], true
+
+	default:
+		return q, len(q) == 0
+	}
+}
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...any) {
+	return func(cond bool, msg string, args ...any) {
+		if cond {
+			return
+		}
+
+		t.Helper()
+		t.Fatalf("Assertion failed: %s", fmt.Sprintf(msg, args...))
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
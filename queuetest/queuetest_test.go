@@ -0,0 +1,39 @@
+// queuetest_test.go - tests for the linearizability checker
+
+package queuetest
+
+import (
+	"testing"
+)
+
+func TestLinearizableChecker(t *testing.T) {
+	assert := newAsserter(t)
+
+	// enq(1) and enq(2) overlap; either order is fine
+	h := history{
+		{call: 1, ret: 4, enq: true, v: 1, ok: true},
+		{call: 2, ret: 3, enq: true, v: 2, ok: true},
+		{call: 5, ret: 6, v: 2, ok: true},
+		{call: 7, ret: 8, v: 1, ok: true},
+	}
+	assert(linearizable(h, 2), "overlapping enqs:\n%s", h)
+
+	// enq(1) completes before enq(2) starts: FIFO violation
+	h[0].ret, h[1].call = 2, 3
+	assert(!linearizable(h, 2), "fifo violation:\n%s", h)
+
+	// a deq that fails while the queue must hold an element
+	h = history{
+		{call: 1, ret: 2, enq: true, v: 1, ok: true},
+		{call: 3, ret: 4},
+	}
+	assert(!linearizable(h, 2), "bad empty:\n%s", h)
+
+	// an enq that fails on a queue that isn't full
+	h = history{
+		{call: 1, ret: 2, enq: true, v: 1, ok: true},
+		{call: 3, ret: 4, enq: true, v: 2},
+	}
+	assert(!linearizable(h, 2), "bad full:\n%s", h)
+	assert(linearizable(h, 1), "full:\n%s", h)
+}
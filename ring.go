@@ -0,0 +1,269 @@
+// ring.go - Fixed size overwrite-oldest ring buffer
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"context"
+	"iter"
+	"time"
+)
+
+// Ring[T] is a fixed-size queue that keeps the most recent elements:
+// Enq on a full ring evicts the oldest element instead of failing.
+// It is useful for "last N events" buffers. Like Q[T], a ring with
+// capacity 'N' will store N elements. The consumer side is the same
+// as Q[T]; PushFront is not available since it fails on a full
+// queue.
+type Ring[T any] struct {
+	q Q[T]
+}
+
+// Make a new ring to hold (at least) 'n' elements. If 'n' is NOT a
+// power-of-2, this function will pick the next closest power-of-2.
+func NewRing[T any](n int) *Ring[T] {
+	r := &Ring[T]{}
+	r.q.init(n)
+	return r
+}
+
+// Enq inserts a new element; if the ring is full, the oldest element
+// is evicted and returned along with true.
+func (r *Ring[T]) Enq(x T) (T, bool) {
+	return r.q.enqOverwrite(x)
+}
+
+// Deq removes the oldest element; see Q.Deq
+func (r *Ring[T]) Deq() (T, bool) {
+	return r.q.Deq()
+}
+
+// PopBack removes the newest element; see Q.PopBack
+func (r *Ring[T]) PopBack() (T, bool) {
+	return r.q.PopBack()
+}
+
+// PeekFront returns the oldest element without removing it
+func (r *Ring[T]) PeekFront() (T, bool) {
+	return r.q.PeekFront()
+}
+
+// PeekBack returns the newest element without removing it
+func (r *Ring[T]) PeekBack() (T, bool) {
+	return r.q.PeekBack()
+}
+
+// At returns the i'th element from the oldest; see Q.At
+func (r *Ring[T]) At(i int) (T, bool) {
+	return r.q.At(i)
+}
+
+// All returns an iterator over the elements of the ring; see Q.All
+func (r *Ring[T]) All() iter.Seq[T] {
+	return r.q.All()
+}
+
+// Drain returns an iterator that dequeues each element of the ring;
+// see Q.Drain
+func (r *Ring[T]) Drain() iter.Seq[T] {
+	return r.q.Drain()
+}
+
+// Flush empties the ring
+func (r *Ring[T]) Flush() {
+	r.q.Flush()
+}
+
+// IsEmpty returns true if the ring is empty
+func (r *Ring[T]) IsEmpty() bool {
+	return r.q.IsEmpty()
+}
+
+// IsFull returns true if the ring is full
+func (r *Ring[T]) IsFull() bool {
+	return r.q.IsFull()
+}
+
+// Len returns the number of elements in the ring
+func (r *Ring[T]) Len() int {
+	return r.q.Len()
+}
+
+// Size returns the capacity of the ring
+func (r *Ring[T]) Size() int {
+	return r.q.Size()
+}
+
+// EnableStats turns on the runtime statistics; see Q.EnableStats
+func (r *Ring[T]) EnableStats() {
+	r.q.EnableStats()
+}
+
+// Stats returns a snapshot of the runtime statistics of this ring
+func (r *Ring[T]) Stats() QStats {
+	return r.q.Stats()
+}
+
+// String dumps the ring in human readable form
+func (r *Ring[T]) String() string {
+	return r.q.repr("Ring")
+}
+
+// SyncRing[T] is a thread-safe version of Ring[T]. Enq never fails;
+// on a full ring it evicts the oldest element. The consumer side is
+// the same as SyncQ[T]; the producer operations of SyncQ that fail or
+// block on a full queue (EnqErr, EnqWait, PushFront etc.) are not
+// available.
+type SyncRing[T any] struct {
+	q SyncQ[T]
+}
+
+// Make a new thread-safe ring to hold (at least) 'n' elements. If 'n'
+// is NOT a power-of-2, this function will pick the next closest
+// power-of-2.
+func NewSyncRing[T any](n int) *SyncRing[T] {
+	r := &SyncRing[T]{}
+	r.q.init(n)
+	return r
+}
+
+// Enq inserts a new element; if the ring is full, the oldest element
+// is evicted and returned along with true. If the ring is closed, 'x'
+// itself is discarded and returned as the evicted element.
+func (r *SyncRing[T]) Enq(x T) (T, bool) {
+	q := &r.q
+	q.lock()
+	if q.closed {
+		q.Unlock()
+		return x, true
+	}
+
+	old, ok := q.enqOverwrite(x)
+	q.notEmpty.wakeup()
+	q.Unlock()
+	return old, ok
+}
+
+// Deq dequeues the oldest element; see SyncQ.Deq
+func (r *SyncRing[T]) Deq() (T, bool) {
+	return r.q.Deq()
+}
+
+// DeqErr dequeues the oldest element; see SyncQ.DeqErr
+func (r *SyncRing[T]) DeqErr() (T, error) {
+	return r.q.DeqErr()
+}
+
+// DeqWait dequeues the oldest element and blocks while the ring is
+// empty; see SyncQ.DeqWait
+func (r *SyncRing[T]) DeqWait(ctx context.Context) (T, error) {
+	return r.q.DeqWait(ctx)
+}
+
+// DeqTimeout is like DeqWait but gives up after duration 'd'
+func (r *SyncRing[T]) DeqTimeout(d time.Duration) (T, error) {
+	return r.q.DeqTimeout(d)
+}
+
+// PopBack removes the newest element; see SyncQ.PopBack
+func (r *SyncRing[T]) PopBack() (T, bool) {
+	return r.q.PopBack()
+}
+
+// PeekFront returns the oldest element without removing it
+func (r *SyncRing[T]) PeekFront() (T, bool) {
+	return r.q.PeekFront()
+}
+
+// PeekBack returns the newest element without removing it
+func (r *SyncRing[T]) PeekBack() (T, bool) {
+	return r.q.PeekBack()
+}
+
+// At returns the i'th element from the oldest; see SyncQ.At
+func (r *SyncRing[T]) At(i int) (T, bool) {
+	return r.q.At(i)
+}
+
+// All returns an iterator over a snapshot of the ring; see SyncQ.All
+func (r *SyncRing[T]) All() iter.Seq[T] {
+	return r.q.All()
+}
+
+// Drain returns an iterator that dequeues each element of the ring;
+// see SyncQ.Drain
+func (r *SyncRing[T]) Drain() iter.Seq[T] {
+	return r.q.Drain()
+}
+
+// Flush empties the ring
+func (r *SyncRing[T]) Flush() {
+	r.q.Flush()
+}
+
+// Close closes the ring for new elements; see SyncQ.Close
+func (r *SyncRing[T]) Close() error {
+	return r.q.Close()
+}
+
+// IsClosed returns true if the ring is closed
+func (r *SyncRing[T]) IsClosed() bool {
+	return r.q.IsClosed()
+}
+
+// IsEmpty returns true if the ring is empty
+func (r *SyncRing[T]) IsEmpty() bool {
+	return r.q.IsEmpty()
+}
+
+// IsFull returns true if the ring is full
+func (r *SyncRing[T]) IsFull() bool {
+	return r.q.IsFull()
+}
+
+// Len returns the number of elements in the ring
+func (r *SyncRing[T]) Len() int {
+	return r.q.Len()
+}
+
+// Size returns the capacity of the ring
+func (r *SyncRing[T]) Size() int {
+	return r.q.Size()
+}
+
+// EnableStats turns on the runtime statistics; see SyncQ.EnableStats
+func (r *SyncRing[T]) EnableStats() {
+	r.q.EnableStats()
+}
+
+// syncStats marks SyncRing as a SyncStatsProvider
+func (r *SyncRing[T]) syncStats() {}
+
+// Stats returns a snapshot of the runtime statistics of this ring
+func (r *SyncRing[T]) Stats() QStats {
+	return r.q.Stats()
+}
+
+// notify lets a Selector wait on the ring; see SyncQ.notify
+func (r *SyncRing[T]) notify() (<-chan struct{}, bool) {
+	return r.q.notify()
+}
+
+// unnotify is a no-op
+func (r *SyncRing[T]) unnotify() {}
+
+// String dumps the ring in human readable form
+func (r *SyncRing[T]) String() string {
+	r.q.lock()
+	s := r.q.repr("SyncRing")
+	r.q.Unlock()
+	return s
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,116 @@
+// ring_test.go - tests for overwrite-oldest rings
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	assert := newAsserter(t)
+
+	r := NewRing[int](4)
+	assert(r.Size() == 4, "size: exp 4, saw %d", r.Size())
+
+	for i := 0; i < 4; i++ {
+		_, ev := r.Enq(i)
+		assert(!ev, "enq-%d: unexpected eviction", i)
+	}
+	assert(r.IsFull(), "expected ring to be full")
+
+	for i := 4; i < 10; i++ {
+		old, ev := r.Enq(i)
+		assert(ev, "enq-%d: expected eviction", i)
+		assert(old == i-4, "enq-%d: evicted exp %d, saw %d", i, i-4, old)
+		assert(r.Len() == 4, "len: exp 4, saw %d", r.Len())
+	}
+
+	v := slices.Collect(r.All())
+	assert(slices.Equal(v, []int{6, 7, 8, 9}), "all: saw %v", v)
+
+	z, ok := r.Deq()
+	assert(ok && z == 6, "deq: exp 6, saw %d", z)
+
+	_, ev := r.Enq(10)
+	assert(!ev, "enq-10: unexpected eviction")
+	v = slices.Collect(r.Drain())
+	assert(slices.Equal(v, []int{7, 8, 9, 10}), "drain: saw %v", v)
+
+	// the Q operations that fail on a full queue are not part of
+	// the ring; Ring and SyncRing share the non-blocking API
+	var rv any = r
+	_, ok = rv.(interface{ PushFront(int) bool })
+	assert(!ok, "Ring has PushFront")
+	_, ok = rv.(interface{ MarshalBinary() ([]byte, error) })
+	assert(!ok, "Ring has MarshalBinary")
+
+	type ringAPI interface {
+		Enq(int) (int, bool)
+		Deq() (int, bool)
+		PopBack() (int, bool)
+		PeekFront() (int, bool)
+		PeekBack() (int, bool)
+		At(int) (int, bool)
+		Flush()
+		IsEmpty() bool
+		IsFull() bool
+		Len() int
+		Size() int
+		Stats() QStats
+		String() string
+	}
+	var _ ringAPI = r
+	var _ ringAPI = NewSyncRing[int](4)
+}
+
+func TestSyncRing(t *testing.T) {
+	assert := newAsserter(t)
+
+	r := NewSyncRing[int](4)
+	for i := 0; i < 6; i++ {
+		old, ev := r.Enq(i)
+		if i < 4 {
+			assert(!ev, "enq-%d: unexpected eviction", i)
+		} else {
+			assert(ev && old == i-4, "enq-%d: evicted exp %d, saw %d", i, i-4, old)
+		}
+	}
+
+	v := slices.Collect(r.All())
+	assert(slices.Equal(v, []int{2, 3, 4, 5}), "all: saw %v", v)
+	r.Flush()
+	assert(r.IsEmpty(), "expected ring to be empty")
+
+	// Enq must wake up blocked consumers
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Enq(42)
+	}()
+	z, err := r.DeqTimeout(5 * time.Second)
+	assert(err == nil, "deq: %v", err)
+	assert(z == 42, "deq: exp 42, saw %d", z)
+
+	// the SyncQ producer operations that fail or block on a full
+	// queue are not part of the ring
+	var rv any = r
+	_, ok := rv.(interface{ EnqErr(int) error })
+	assert(!ok, "SyncRing has EnqErr")
+	_, ok = rv.(interface {
+		EnqWait(context.Context, int) error
+	})
+	assert(!ok, "SyncRing has EnqWait")
+	_, ok = rv.(interface{ PushFront(int) bool })
+	assert(!ok, "SyncRing has PushFront")
+	_, ok = rv.(notifier)
+	assert(ok, "SyncRing can't notify a Selector")
+
+	assert(r.Close() == nil, "close failed")
+	old, ev := r.Enq(7)
+	assert(ev && old == 7, "enq on closed ring: saw %d %v", old, ev)
+	_, err = r.DeqErr()
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+}
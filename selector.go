@@ -0,0 +1,272 @@
+// selector.go - Multiplexed dequeue across several queues
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// SelectOrder is the order in which a Selector visits its queues
+type SelectOrder int
+
+const (
+	// RoundRobin visits the queues in turn; the weights are ignored
+	RoundRobin SelectOrder = iota
+
+	// WeightedFair dequeues from each busy queue in proportion to
+	// its weight (deficit round-robin).
+	WeightedFair
+)
+
+// Selector dequeues from several queues: it is the select{} of this
+// package's queues. Each call returns the next available element
+// along with the index of the queue it came from. A Selector is the
+// consumer of all its queues and must only be used by one go-routine.
+//
+// SelectWait blocks until any queue has data. Queues that can notify
+// a waiter (SyncQ, types embedding it, PersistentQ and SPSCQ with the
+// SpinPark wait strategy) are waited on. The others (e.g., SPSCQ with
+// any other wait strategy, MPSCQ) are polled with an exponential
+// backoff that adds up to 2ms to the latency of their elements.
+type Selector[T any] struct {
+	order SelectOrder
+	srcs  []selSource[T]
+	next  int // next queue to visit
+
+	// reused by wait()
+	cases []reflect.SelectCase
+	tm    *time.Timer
+}
+
+type selSource[T any] struct {
+	q      Dequeuer[T]
+	weight int
+	left   int // picks left in this turn for WeightedFair
+}
+
+// notifier is implemented by queues that can tell a waiter when they
+// are no longer empty.
+type notifier interface {
+	// notify returns a channel that is closed when the queue is
+	// not empty or closed; nil means the queue must be polled.
+	// 'done' is true if the queue is closed and empty: it will
+	// never have data again and must not be waited on.
+	notify() (ch <-chan struct{}, done bool)
+
+	// unnotify ends the wait started by notify
+	unnotify()
+}
+
+// closer is implemented by queues that can be closed
+type closer interface {
+	IsClosed() bool
+}
+
+// NewSelector makes a new selector that visits its queues in 'order'
+func NewSelector[T any](order SelectOrder) *Selector[T] {
+	return &Selector[T]{
+		order: order,
+	}
+}
+
+// Add registers the queue 'q' with weight 'weight' and returns its
+// index; a weight less than 1 is treated as 1.
+func (s *Selector[T]) Add(q Dequeuer[T], weight int) int {
+	s.srcs = append(s.srcs, selSource[T]{
+		q:      q,
+		weight: max(weight, 1),
+	})
+	return len(s.srcs) - 1
+}
+
+// Len returns the number of registered queues
+func (s *Selector[T]) Len() int {
+	return len(s.srcs)
+}
+
+// Select dequeues the next available element and returns it along
+// with the index of its queue; it returns false if all the queues
+// are empty.
+func (s *Selector[T]) Select() (T, int, bool) {
+	if s.order == WeightedFair {
+		return s.selectWeighted()
+	}
+
+	n := len(s.srcs)
+	for i := 0; i < n; i++ {
+		j := (s.next + i) % n
+		if x, ok := s.srcs[j].q.Deq(); ok {
+			s.next = (j + 1) % n
+			return x, j, true
+		}
+	}
+
+	var z T
+	return z, -1, false
+}
+
+// selectWeighted is a deficit round-robin: each queue in turn gives
+// up to 'weight' elements before the next queue goes. An empty queue
+// forfeits the rest of its turn so that it neither banks nor owes
+// picks.
+func (s *Selector[T]) selectWeighted() (T, int, bool) {
+	n := len(s.srcs)
+	for i := 0; i < n; i++ {
+		j := s.next
+		c := &s.srcs[j]
+		if c.left == 0 {
+			c.left = c.weight
+		}
+
+		if x, ok := c.q.Deq(); ok {
+			if c.left--; c.left == 0 {
+				s.next = (j + 1) % n
+			}
+			return x, j, true
+		}
+
+		c.left = 0
+		s.next = (j + 1) % n
+	}
+
+	var z T
+	return z, -1, false
+}
+
+// SelectWait is like Select but blocks until an element is available
+// or the context is done. It returns ErrClosed if all the queues are
+// closed and empty and the context error if the context is done
+// first. Like an empty select{}, a selector without queues blocks
+// until the context is done.
+func (s *Selector[T]) SelectWait(ctx context.Context) (T, int, error) {
+	var b backoff
+
+	if len(s.srcs) == 0 {
+		<-ctx.Done()
+		var z T
+		return z, -1, ctx.Err()
+	}
+
+	for {
+		if x, i, ok := s.Select(); ok {
+			return x, i, nil
+		}
+
+		if s.closed() {
+			// elements enqueued before Close() must still be delivered
+			if x, i, ok := s.Select(); ok {
+				return x, i, nil
+			}
+			var z T
+			return z, -1, ErrClosed
+		}
+
+		if err := s.wait(ctx, &b); err != nil {
+			var z T
+			return z, -1, err
+		}
+	}
+}
+
+// wait blocks until a queue that can notify is ready, the next poll
+// of the other queues is due or the context is done. Queues that are
+// closed and empty are left out; they can only end the whole set.
+func (s *Selector[T]) wait(ctx context.Context, b *backoff) error {
+	cases := append(s.cases[:0], reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(ctx.Done()),
+	})
+
+	var poll bool
+	for i := range s.srcs {
+		var ch <-chan struct{}
+		if nq, ok := s.srcs[i].q.(notifier); ok {
+			var done bool
+			if ch, done = nq.notify(); done {
+				continue
+			}
+		}
+		if ch == nil {
+			poll = true
+			continue
+		}
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(ch),
+		})
+	}
+
+	if poll {
+		d := b.next()
+		if s.tm == nil {
+			s.tm = time.NewTimer(d)
+		} else {
+			s.tm.Reset(d)
+		}
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(s.tm.C),
+		})
+	}
+
+	// all the queues closed since the caller looked; don't block
+	// on the context alone.
+	i := -1
+	if len(cases) > 1 {
+		i, _, _ = reflect.Select(cases)
+	}
+
+	for j := range s.srcs {
+		if nq, ok := s.srcs[j].q.(notifier); ok {
+			nq.unnotify()
+		}
+	}
+	if poll {
+		s.tm.Stop()
+	}
+
+	// drop the references to the channels until the next wait
+	clear(cases)
+	s.cases = cases[:0]
+
+	switch {
+	case i == 0:
+		return ctx.Err()
+	case i > 0 && (!poll || i != len(cases)-1):
+		// a queue is ready; start polling afresh
+		*b = backoff{}
+	}
+	return nil
+}
+
+// closed returns true if all the queues are closed
+func (s *Selector[T]) closed() bool {
+	for i := range s.srcs {
+		c, ok := s.srcs[i].q.(closer)
+		if !ok || !c.IsClosed() {
+			return false
+		}
+	}
+	return len(s.srcs) > 0
+}
+
+// String returns a human readable description of the selector
+func (s *Selector[T]) String() string {
+	nm := "round-robin"
+	if s.order == WeightedFair {
+		nm = "weighted-fair"
+	}
+	return fmt.Sprintf("<Selector %T %s queues=%d>", s, nm, len(s.srcs))
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
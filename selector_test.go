@@ -0,0 +1,336 @@
+// selector_test.go - tests for Selector
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSelectorRoundRobin(t *testing.T) {
+	assert := newAsserter(t)
+
+	s := NewSelector[int](RoundRobin)
+	qs := []*Q[int]{NewQ[int](8), NewQ[int](8), NewQ[int](8)}
+	for i, q := range qs {
+		j := s.Add(q, 0)
+		assert(j == i, "add: exp index %d, saw %d", i, j)
+	}
+	assert(s.Len() == 3, "len: exp 3, saw %d", s.Len())
+
+	_, i, ok := s.Select()
+	assert(!ok && i == -1, "select on empty queues")
+
+	// q0: 0, 1, 2; q1: 10; q2: 20, 21
+	qs[0].Enq(0)
+	qs[0].Enq(1)
+	qs[0].Enq(2)
+	qs[1].Enq(10)
+	qs[2].Enq(20)
+	qs[2].Enq(21)
+
+	exp := []struct{ v, i int }{
+		{0, 0}, {10, 1}, {20, 2}, {1, 0}, {21, 2}, {2, 0},
+	}
+	for k, e := range exp {
+		x, i, ok := s.Select()
+		assert(ok, "select-%d failed", k)
+		assert(x == e.v && i == e.i, "select-%d: exp %d from %d, saw %d from %d", k, e.v, e.i, x, i)
+	}
+	_, _, ok = s.Select()
+	assert(!ok, "select on drained queues")
+}
+
+func TestSelectorWeighted(t *testing.T) {
+	assert := newAsserter(t)
+
+	const N = 400
+
+	s := NewSelector[int](WeightedFair)
+	a := NewQ[int](N)
+	b := NewQ[int](N)
+	c := NewQ[int](N)
+	s.Add(a, 3)
+	s.Add(b, 1)
+	s.Add(c, 1)
+
+	for i := 0; i < N; i++ {
+		a.Enq(i)
+		b.Enq(i)
+	}
+
+	// 'c' is empty and must not hold back the busy queues
+	var cnt [3]int
+	var last [3]int
+	for i := 0; i < N; i++ {
+		x, j, ok := s.Select()
+		assert(ok, "select-%d failed", i)
+		assert(cnt[j] == 0 || x == last[j]+1, "queue %d: fifo violation %d after %d", j, x, last[j])
+		cnt[j]++
+		last[j] = x
+	}
+	assert(cnt[0] == 3*N/4 && cnt[1] == N/4 && cnt[2] == 0,
+		"weights 3:1: saw %v", cnt)
+
+	// once 'a' drains, 'b' gets all the picks
+	for {
+		_, j, ok := s.Select()
+		if !ok {
+			break
+		}
+		cnt[j]++
+	}
+	assert(cnt[0] == N && cnt[1] == N, "drain: saw %v", cnt)
+
+	// a queue that was empty earns its share when it has data
+	for i := 0; i < 8; i++ {
+		a.Enq(i)
+		c.Enq(i)
+	}
+	cnt = [3]int{}
+	for i := 0; i < 8; i++ {
+		_, j, ok := s.Select()
+		assert(ok, "select-%d failed", i)
+		cnt[j]++
+	}
+	assert(cnt[0] == 6 && cnt[2] == 2, "weights 3:1 after refill: saw %v", cnt)
+}
+
+func TestSelectorWait(t *testing.T) {
+	assert := newAsserter(t)
+
+	s := NewSelector[int](RoundRobin)
+	sq := NewSyncQ[int](4)
+	sp := NewSPSCQ[int](4)
+	s.Add(sq, 1)
+	s.Add(sp, 1)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sq.Enq(1)
+		time.Sleep(20 * time.Millisecond)
+		sp.Enq(2)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	x, i, err := s.SelectWait(ctx)
+	assert(err == nil, "wait-1: %v", err)
+	assert(x == 1 && i == 0, "wait-1: exp 1 from 0, saw %d from %d", x, i)
+
+	x, i, err = s.SelectWait(ctx)
+	assert(err == nil, "wait-2: %v", err)
+	assert(x == 2 && i == 1, "wait-2: exp 2 from 1, saw %d from %d", x, i)
+
+	// a waiter blocked only on notifying queues
+	s = NewSelector[int](WeightedFair)
+	sq2 := NewSyncQ[int](4)
+	s.Add(sq, 1)
+	s.Add(sq2, 2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sq2.Enq(3)
+	}()
+	x, i, err = s.SelectWait(ctx)
+	assert(err == nil, "wait-3: %v", err)
+	assert(x == 3 && i == 1, "wait-3: exp 3 from 1, saw %d from %d", x, i)
+}
+
+func TestSelectorTimeout(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, poll := range []bool{false, true} {
+		s := NewSelector[int](RoundRobin)
+		s.Add(NewSyncQ[int](4), 1)
+		if poll {
+			s.Add(NewSPSCQ[int](4), 1)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, i, err := s.SelectWait(ctx)
+		cancel()
+		assert(errors.Is(err, context.DeadlineExceeded), "poll %v: exp timeout, saw %v", poll, err)
+		assert(i == -1, "poll %v: exp index -1, saw %d", poll, i)
+	}
+}
+
+func TestSelectorEmpty(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a selector without queues waits for the context
+	s := NewSelector[int](RoundRobin)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, i, err := s.SelectWait(ctx)
+	assert(errors.Is(err, context.DeadlineExceeded), "exp timeout, saw %v", err)
+	assert(i == -1, "exp index -1, saw %d", i)
+
+	_, i, err = s.SelectWait(ctx)
+	assert(errors.Is(err, context.DeadlineExceeded), "done ctx: exp timeout, saw %v", err)
+	assert(i == -1, "done ctx: exp index -1, saw %d", i)
+}
+
+func TestSelectorClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	s := NewSelector[int](RoundRobin)
+	a := NewSyncQ[int](4)
+	b := NewSPSCQ[int](4)
+	s.Add(a, 1)
+	s.Add(b, 1)
+
+	a.Enq(1)
+	b.Enq(2)
+	a.Close()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Close()
+	}()
+
+	// queued elements are delivered before ErrClosed
+	ctx := context.Background()
+	seen := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		x, _, err := s.SelectWait(ctx)
+		assert(err == nil, "wait-%d: %v", i, err)
+		seen[x] = true
+	}
+	assert(seen[1] && seen[2], "exp 1 and 2, saw %v", seen)
+
+	_, i, err := s.SelectWait(ctx)
+	assert(errors.Is(err, ErrClosed), "exp ErrClosed, saw %v", err)
+	assert(i == -1, "exp index -1, saw %d", i)
+
+	// a selector with a queue that can't be closed never reports ErrClosed
+	s.Add(NewQ[int](4), 1)
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, _, err = s.SelectWait(tctx)
+	assert(errors.Is(err, context.DeadlineExceeded), "exp timeout, saw %v", err)
+}
+
+func TestSelectorNotify(t *testing.T) {
+	assert := newAsserter(t)
+
+	var _ notifier = &SyncQ[int]{}
+	var _ notifier = &SPSCQ[int]{}
+	var _ notifier = &PersistentQ[int]{}
+
+	// only SpinPark can notify; the other strategies are polled
+	pq := NewSPSCQ[int](4)
+	pch, done := pq.notify()
+	assert(pch == nil && !done, "spin-yield: exp nil notify channel")
+	pq.unnotify()
+
+	sp := NewSpinPark(0)
+	q := NewSPSCQ(4, WithWaitStrategy[int](sp))
+	ch, done := q.notify()
+	assert(ch != nil && !done, "spin-park: exp notify channel")
+	select {
+	case <-ch:
+		t.Fatalf("spin-park: empty queue notified")
+	default:
+	}
+	q.Enq(1)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("spin-park: enq didn't notify")
+	}
+	q.unnotify()
+	assert(sp.waiters.Load() == 0, "spin-park: waiters: exp 0, saw %d", sp.waiters.Load())
+
+	// a non-empty queue notifies right away
+	ch, _ = q.notify()
+	q.unnotify()
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("spin-park: non-empty queue didn't notify")
+	}
+
+	// the selector waits on the queue instead of polling it
+	q.Deq()
+	s := NewSelector[int](RoundRobin)
+	sq := NewSyncQ[int](4)
+	s.Add(sq, 1)
+	s.Add(q, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Enq(2)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	x, i, err := s.SelectWait(ctx)
+	assert(err == nil, "wait: %v", err)
+	assert(x == 2 && i == 1, "wait: exp 2 from 1, saw %d from %d", x, i)
+	assert(s.tm == nil, "selector polled a notifying queue")
+	assert(sp.waiters.Load() == 0, "selector: waiters: exp 0, saw %d", sp.waiters.Load())
+
+	// closing the queue wakes up the selector
+	sq.Close()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Close()
+	}()
+	_, _, err = s.SelectWait(ctx)
+	assert(errors.Is(err, ErrClosed), "close: exp ErrClosed, saw %v", err)
+}
+
+// wakeQ counts the times a Selector waited on the SyncQ it wraps
+type wakeQ struct {
+	*SyncQ[int]
+	n int
+}
+
+func (q *wakeQ) notify() (<-chan struct{}, bool) {
+	q.n++
+	return q.SyncQ.notify()
+}
+
+func TestSelectorClosedIdle(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a closed and empty queue must not wake up a selector that
+	// waits on another queue that is open and empty.
+	a := NewSyncQ[int](4)
+	b := NewSPSCQ(4, WithWaitStrategy[int](NewSpinPark(0)))
+	c := NewSPSCQ[int](4)
+	a.Close()
+	b.Close()
+	c.Close()
+
+	for _, done := range []notifier{a, b, c} {
+		ch, ok := done.notify()
+		done.unnotify()
+		assert(ch == nil && ok, "%T: exp done", done)
+	}
+
+	w := &wakeQ{SyncQ: NewSyncQ[int](4)}
+	s := NewSelector[int](RoundRobin)
+	s.Add(a, 1)
+	s.Add(b, 1)
+	s.Add(c, 1)
+	s.Add(w, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := s.SelectWait(ctx)
+	assert(errors.Is(err, context.DeadlineExceeded), "exp timeout, saw %v", err)
+	assert(w.n == 1, "idle selector woke up %d times", w.n)
+	assert(s.tm == nil, "selector polled a closed queue")
+
+	// closing the last queue ends the wait
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		w.Close()
+	}()
+	_, _, err = s.SelectWait(context.Background())
+	assert(errors.Is(err, ErrClosed), "exp ErrClosed, saw %v", err)
+}
@@ -0,0 +1,202 @@
+// shardedq.go - Queue sharded over several SyncQ instances
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// ShardedQ[T] is a thread-safe, bounded queue that spreads its
+// elements over several SyncQ shards so that concurrent producers and
+// consumers don't all contend on one lock.
+//
+// FIFO order holds only per shard: elements enqueued to the same
+// shard are dequeued in the order they were enqueued, but there is no
+// ordering between elements in different shards. Use EnqHint with the
+// same hint (e.g., a hash of a flow or session key) for elements
+// whose relative order matters.
+//
+// Producers pick a shard with a hint (EnqHint), by affinity (a
+// ShardProducer handle is bound to one shard) or round-robin (Enq).
+// Consumers drain the shards round-robin (Deq) or prefer their own
+// shard and steal from the others when it is empty (ShardConsumer).
+type ShardedQ[T any] struct {
+	shards []*SyncQ[T]
+
+	// round-robin counters for Enq, Deq and the handles
+	wr   atomic.Uint64
+	_    [7]uint64 // cache-line pad
+	rd   atomic.Uint64
+	_    [7]uint64 // cache-line pad
+	prod atomic.Uint64
+	cons atomic.Uint64
+}
+
+// NewShardedQ makes a new sharded queue with 'nshards' shards, each
+// of which holds (at least) 'n' elements. If 'nshards' is not
+// positive, the queue has one shard per CPU (GOMAXPROCS). The options
+// apply to each shard.
+func NewShardedQ[T any](nshards, n int, opts ...QOption[T]) *ShardedQ[T] {
+	if nshards <= 0 {
+		nshards = runtime.GOMAXPROCS(0)
+	}
+
+	q := &ShardedQ[T]{
+		shards: make([]*SyncQ[T], nshards),
+	}
+	for i := range q.shards {
+		q.shards[i] = NewSyncQ(n, opts...)
+	}
+	return q
+}
+
+// Enq enqueues a new element to the next shard in round-robin order;
+// if that shard is full, the other shards are tried in turn. The
+// backpressure policy only applies when all the shards are full. It
+// returns false if the element was not enqueued. Successive calls to
+// Enq are not ordered relative to each other.
+func (q *ShardedQ[T]) Enq(x T) bool {
+	i := q.wr.Add(1)
+	n := uint64(len(q.shards))
+	for j := uint64(0); j < n; j++ {
+		switch err := q.shard(i + j).EnqErr(x); err {
+		case nil:
+			return true
+		case ErrClosed:
+			return false
+		}
+	}
+
+	// every shard is full; let the policy decide
+	return q.shard(i).Enq(x)
+}
+
+// EnqHint enqueues a new element to the shard selected by 'hint';
+// elements with the same hint go to the same shard and are dequeued
+// in FIFO order. It returns false if the element was not enqueued.
+func (q *ShardedQ[T]) EnqHint(hint uint64, x T) bool {
+	return q.shard(hint).Enq(x)
+}
+
+// Deq dequeues an element, visiting the shards round-robin; it
+// returns false if all the shards are empty.
+func (q *ShardedQ[T]) Deq() (T, bool) {
+	return q.deqFrom(q.rd.Add(1))
+}
+
+// deqFrom dequeues from the first non-empty shard starting at
+// shard 'i'.
+func (q *ShardedQ[T]) deqFrom(i uint64) (T, bool) {
+	n := uint64(len(q.shards))
+	for j := uint64(0); j < n; j++ {
+		if x, ok := q.shards[(i+j)%n].Deq(); ok {
+			return x, true
+		}
+	}
+
+	var z T
+	return z, false
+}
+
+// Producer returns a producer handle bound to one of the shards;
+// the shards are handed out round-robin. All the elements enqueued
+// by a handle are dequeued in FIFO order.
+func (q *ShardedQ[T]) Producer() *ShardProducer[T] {
+	return &ShardProducer[T]{
+		q: q.shard(q.prod.Add(1) - 1),
+	}
+}
+
+// Consumer returns a consumer handle whose home is one of the
+// shards; the shards are handed out round-robin.
+func (q *ShardedQ[T]) Consumer() *ShardConsumer[T] {
+	return &ShardConsumer[T]{
+		q:    q,
+		home: q.cons.Add(1) - 1,
+	}
+}
+
+// Close closes all the shards; see SyncQ.Close. The remaining
+// elements can still be dequeued.
+func (q *ShardedQ[T]) Close() error {
+	var err error
+	for _, s := range q.shards {
+		if e := s.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Shards returns the number of shards
+func (q *ShardedQ[T]) Shards() int {
+	return len(q.shards)
+}
+
+// Len returns the number of elements in all the shards. In the
+// presence of concurrent producers and consumers, this is only a
+// snapshot.
+func (q *ShardedQ[T]) Len() int {
+	var n int
+	for _, s := range q.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// IsEmpty returns true if all the shards are empty
+func (q *ShardedQ[T]) IsEmpty() bool {
+	return q.Len() == 0
+}
+
+// Size returns the total capacity of all the shards
+func (q *ShardedQ[T]) Size() int {
+	return len(q.shards) * q.shards[0].Size()
+}
+
+// String returns a human readable description of the queue
+func (q *ShardedQ[T]) String() string {
+	return fmt.Sprintf("<ShardedQ %T shards=%d cap=%d len=%d>",
+		q, len(q.shards), q.Size(), q.Len())
+}
+
+func (q *ShardedQ[T]) shard(i uint64) *SyncQ[T] {
+	return q.shards[i%uint64(len(q.shards))]
+}
+
+// ShardProducer is a producer handle of a ShardedQ that always
+// enqueues to the same shard.
+type ShardProducer[T any] struct {
+	q *SyncQ[T]
+}
+
+// Enq enqueues a new element to the shard of this handle; it returns
+// false if the element was not enqueued.
+func (p *ShardProducer[T]) Enq(x T) bool {
+	return p.q.Enq(x)
+}
+
+// ShardConsumer is a consumer handle of a ShardedQ that prefers its
+// home shard and steals from the other shards when it is empty.
+type ShardConsumer[T any] struct {
+	q    *ShardedQ[T]
+	home uint64
+}
+
+// Deq dequeues an element from the home shard; if it is empty, the
+// other shards are tried in turn. It returns false if all the shards
+// are empty.
+func (c *ShardConsumer[T]) Deq() (T, bool) {
+	return c.q.deqFrom(c.home)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
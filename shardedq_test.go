@@ -0,0 +1,167 @@
+// shardedq_test.go - tests for the sharded queue
+
+package utils
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewShardedQ[int](4, 8)
+	assert(q.Shards() == 4, "shards: exp 4, saw %d", q.Shards())
+	assert(q.Size() == 32, "size: exp 32, saw %d", q.Size())
+	assert(q.IsEmpty(), "expected q to be empty")
+
+	_, ok := q.Deq()
+	assert(!ok, "deq on empty q")
+
+	// same hint => same shard => FIFO
+	for i := 0; i < 8; i++ {
+		assert(q.EnqHint(7, i), "enq-%d failed", i)
+	}
+	assert(!q.EnqHint(7, 8), "enq to full shard should fail")
+	assert(q.EnqHint(8, 100), "enq to another shard failed")
+	assert(q.Len() == 9, "len: exp 9, saw %d", q.Len())
+
+	var v []int
+	for {
+		x, ok := q.Deq()
+		if !ok {
+			break
+		}
+		if x != 100 {
+			v = append(v, x)
+		}
+	}
+	for i, x := range v {
+		assert(x == i, "deq: exp %d, saw %d", i, x)
+	}
+	assert(len(v) == 8, "deq: exp 8 elements, saw %d", len(v))
+
+	// producer handles are spread over the shards
+	p0, p1 := q.Producer(), q.Producer()
+	assert(p0.Enq(1) && p1.Enq(2), "producer enq failed")
+	assert(q.shards[0].Len() == 1 && q.shards[1].Len() == 1, "producers share a shard\n%s", q)
+
+	// a consumer steals when its home shard is empty
+	c0, c1, c2 := q.Consumer(), q.Consumer(), q.Consumer()
+	x, ok := c1.Deq()
+	assert(ok && x == 2, "consumer-1: exp 2, saw %d", x)
+	x, ok = c2.Deq()
+	assert(ok && x == 1, "consumer-2: exp 1, saw %d", x)
+	_, ok = c0.Deq()
+	assert(!ok, "deq on empty q")
+
+	assert(q.Enq(5), "enq failed")
+	assert(q.Close() == nil, "close failed")
+	assert(errors.Is(q.Close(), ErrClosed), "double close: exp ErrClosed")
+	assert(!q.Enq(6), "enq on closed q")
+	x, ok = q.Deq()
+	assert(ok && x == 5, "deq: exp 5, saw %d", x)
+}
+
+func TestShardedQFull(t *testing.T) {
+	assert := newAsserter(t)
+
+	// Enq only fails when every shard is full
+	var drops int
+	q := NewShardedQ(4, 2, WithDropFunc(func(int) { drops++ }))
+	for i := 0; i < 2; i++ {
+		assert(q.EnqHint(0, i), "hint enq-%d failed", i)
+	}
+	assert(q.shards[0].IsFull(), "shard 0: exp full\n%s", q)
+	for i := 0; i < q.Size()-2; i++ {
+		assert(q.Enq(i), "enq-%d failed with %d of %d slots used", i, q.Len(), q.Size())
+	}
+	assert(q.Len() == q.Size(), "len: exp %d, saw %d", q.Size(), q.Len())
+	assert(drops == 0, "drops before q is full: %d", drops)
+
+	assert(!q.Enq(100), "enq to full q")
+	assert(drops == 1, "drops: exp 1, saw %d", drops)
+
+	// the policy applies once all the shards are full
+	eq := NewShardedQ(2, 1, WithPolicy[int](Error))
+	assert(eq.Enq(1) && eq.Enq(2), "enq failed")
+	assert(eq.shards[0].Err() == nil && eq.shards[1].Err() == nil, "error recorded before q is full")
+	assert(!eq.Enq(3), "enq to full q")
+}
+
+func TestShardedQConcurrency(t *testing.T) {
+	assert := newAsserter(t)
+
+	const P = 4
+	const C = 4
+	const N = 5000
+
+	q := NewShardedQ[int](P, 64)
+	seen := make([]atomic.Int32, P*N)
+
+	var prod, cons sync.WaitGroup
+	var done atomic.Bool
+
+	prod.Add(P)
+	for i := 0; i < P; i++ {
+		p := q.Producer()
+		go func(base int) {
+			defer prod.Done()
+			for j := 0; j < N; {
+				if p.Enq(base + j) {
+					j++
+				} else {
+					runtime.Gosched()
+				}
+			}
+		}(i * N)
+	}
+
+	cons.Add(C)
+	for i := 0; i < C; i++ {
+		c := q.Consumer()
+		go func(rr bool) {
+			defer cons.Done()
+
+			// per-shard FIFO => per-producer FIFO
+			last := make([]int, P)
+			for k := range last {
+				last[k] = -1
+			}
+
+			deq := c.Deq
+			if rr {
+				deq = q.Deq
+			}
+			for {
+				x, ok := deq()
+				if !ok {
+					if done.Load() && q.IsEmpty() {
+						return
+					}
+					runtime.Gosched()
+					continue
+				}
+
+				seen[x].Add(1)
+				p, j := x/N, x%N
+				if j <= last[p] {
+					t.Errorf("producer %d: saw %d after %d", p, j, last[p])
+				}
+				last[p] = j
+			}
+		}(i%2 == 0)
+	}
+
+	prod.Wait()
+	done.Store(true)
+	cons.Wait()
+
+	for i := range seen {
+		n := seen[i].Load()
+		assert(n == 1, "elem %d: seen %d times", i, n)
+	}
+}
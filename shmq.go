@@ -0,0 +1,307 @@
+// shmq.go - Cross-process SPSC queue in shared memory
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Notes:
+//   - the shared memory layout is a versioned header followed by the
+//     ring of fixed size records:
+//       0: magic, version, record size, number of slots
+//      64: rd index (own cache line)
+//     128: wr index (own cache line)
+//     192: records
+//   - the rd/wr indices follow SPSCQ: they are free running counters
+//     masked on access, and a ring with 'N' slots stores N records.
+//   - the cached rd/wr indices are private to each process.
+
+const (
+	shmMagic   uint64 = 0x51434d48535f4f47 // "GO_SHMCQ"
+	shmVersion uint64 = 2
+
+	shmRdOff   = 64
+	shmWrOff   = 128
+	shmDataOff = 192
+)
+
+// ErrShmMismatch is returned when attaching to a shared memory queue
+// whose layout doesn't match the caller's expectations.
+var ErrShmMismatch = errors.New("shmq: mismatched queue")
+
+// ShmQ is a bounded single-producer/single-consumer queue of fixed
+// size records in shared memory; the producer and consumer can be in
+// different processes. One process creates the queue and the other
+// attaches to it by path (or by file descriptor). This queue always
+// has a power-of-2 size. For a queue with capacity 'N', it will store
+// N records.
+type ShmQ struct {
+	rd *atomic.Uint64
+	wr *atomic.Uint64
+
+	rdc uint64 // read-index cached by the producer
+	wrc uint64 // write-index cached by the consumer
+
+	mask  uint64
+	recsz uint64
+	data  []byte
+
+	mem []byte
+	fd  *os.File
+}
+
+// CreateShmQ creates a new shared memory queue backed by the file
+// 'path' to hold at-least 'n' records of 'recsz' bytes each. If 'n'
+// is not a power-of-2, this function will pick the next closest
+// power-of-2. An existing file is truncated.
+func CreateShmQ(path string, recsz, n int) (*ShmQ, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := CreateShmQFile(fd, recsz, n)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// OpenShmQ attaches to an existing shared memory queue backed by the
+// file 'path'. It returns ErrShmMismatch if the record size or the
+// capacity of the queue don't match 'recsz' and 'n'.
+func OpenShmQ(path string, recsz, n int) (*ShmQ, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := OpenShmQFile(fd, recsz, n)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// CreateShmQFile is like CreateShmQ but uses the already open file
+// 'fd' (e.g., a memfd). The queue takes ownership of 'fd'.
+func CreateShmQFile(fd *os.File, recsz, n int) (*ShmQ, error) {
+	if recsz <= 0 || n <= 0 {
+		return nil, fmt.Errorf("shmq: invalid record size %d or count %d", recsz, n)
+	}
+
+	z := nextpow2(uint64(n))                         //#nosec G115 -- checked above
+	size := shmDataOff + z*uint64(recsz)             //#nosec G115 -- checked above
+	if err := fd.Truncate(int64(size)); err != nil { //#nosec G115 -- 64-bit platforms
+		return nil, err
+	}
+
+	q, err := newShmQ(fd, size, uint64(recsz), z) //#nosec G115 -- checked above
+	if err != nil {
+		return nil, err
+	}
+
+	h := q.hdr()
+	h[1].Store(shmVersion)
+	h[2].Store(q.recsz)
+	h[3].Store(z)
+	q.rd.Store(0)
+	q.wr.Store(0)
+
+	// the magic is written last; it marks the header as valid
+	h[0].Store(shmMagic)
+	return q, nil
+}
+
+// OpenShmQFile is like OpenShmQ but uses the already open file 'fd'
+// (e.g., a memfd inherited from the creator). The queue takes
+// ownership of 'fd'.
+func OpenShmQFile(fd *os.File, recsz, n int) (*ShmQ, error) {
+	if recsz <= 0 || n <= 0 {
+		return nil, fmt.Errorf("shmq: invalid record size %d or count %d", recsz, n)
+	}
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	z := nextpow2(uint64(n))             //#nosec G115 -- checked above
+	size := shmDataOff + z*uint64(recsz) //#nosec G115 -- checked above
+	if st.Size() != int64(size) {        //#nosec G115 -- 64-bit platforms
+		return nil, fmt.Errorf("%w: size %d, exp %d", ErrShmMismatch, st.Size(), size)
+	}
+
+	q, err := newShmQ(fd, size, uint64(recsz), z) //#nosec G115 -- checked above
+	if err != nil {
+		return nil, err
+	}
+
+	h := q.hdr()
+	switch {
+	case h[0].Load() != shmMagic:
+		err = fmt.Errorf("%w: bad magic", ErrShmMismatch)
+	case h[1].Load() != shmVersion:
+		err = fmt.Errorf("%w: version %d, exp %d", ErrShmMismatch, h[1].Load(), shmVersion)
+	case h[2].Load() != q.recsz:
+		err = fmt.Errorf("%w: record size %d, exp %d", ErrShmMismatch, h[2].Load(), q.recsz)
+	case h[3].Load() != z:
+		err = fmt.Errorf("%w: capacity %d, exp %d", ErrShmMismatch, h[3].Load(), z)
+	}
+
+	if err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func newShmQ(fd *os.File, size, recsz, z uint64) (*ShmQ, error) {
+	mem, err := syscall.Mmap(int(fd.Fd()), 0, int(size), //#nosec G115 -- 64-bit platforms
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("shmq: mmap: %w", err)
+	}
+
+	q := &ShmQ{
+		rd:    (*atomic.Uint64)(unsafe.Pointer(&mem[shmRdOff])),
+		wr:    (*atomic.Uint64)(unsafe.Pointer(&mem[shmWrOff])),
+		mask:  z - 1,
+		recsz: recsz,
+		data:  mem[shmDataOff:],
+		mem:   mem,
+		fd:    fd,
+	}
+	return q, nil
+}
+
+// hdr returns the header words
+func (q *ShmQ) hdr() *[4]atomic.Uint64 {
+	return (*[4]atomic.Uint64)(unsafe.Pointer(&q.mem[0]))
+}
+
+// Close unmaps the shared memory and closes the backing file; it
+// doesn't remove the file.
+func (q *ShmQ) Close() error {
+	err := syscall.Munmap(q.mem)
+	if e := q.fd.Close(); err == nil {
+		err = e
+	}
+
+	q.mem = nil
+	q.data = nil
+	return err
+}
+
+// Enq enqueues a copy of the record 'b'; a record shorter than the
+// record size is zero padded. Returns true on success and false when
+// the queue is full. Enq panics if 'b' is larger than the record size.
+func (q *ShmQ) Enq(b []byte) bool {
+	if uint64(len(b)) > q.recsz {
+		panic(fmt.Sprintf("shmq: record too large (%d > %d)", len(b), q.recsz))
+	}
+
+	wr := q.wr.Load()
+	if qfull(q.rdc, wr, q.mask+1) {
+		if q.rdc = q.rd.Load(); qfull(q.rdc, wr, q.mask+1) {
+			return false
+		}
+	}
+
+	r := q.rec(wr & q.mask)
+	n := copy(r, b)
+	clear(r[n:])
+	q.wr.Store(wr + 1)
+	return true
+}
+
+// Deq dequeues the oldest record into 'b' and returns true; it
+// returns false if the queue is empty. Deq panics if 'b' is smaller
+// than the record size.
+func (q *ShmQ) Deq(b []byte) bool {
+	if uint64(len(b)) < q.recsz {
+		panic(fmt.Sprintf("shmq: buffer too small (%d < %d)", len(b), q.recsz))
+	}
+
+	rd := q.rd.Load()
+	if rd == q.wrc {
+		if q.wrc = q.wr.Load(); rd == q.wrc {
+			return false
+		}
+	}
+
+	copy(b, q.rec(rd&q.mask))
+	q.rd.Store(rd + 1)
+	return true
+}
+
+// IsEmpty returns true if the queue is empty
+func (q *ShmQ) IsEmpty() bool {
+	rd, wr := q.load()
+	return qempty(rd, wr)
+}
+
+// IsFull returns true if the queue is full
+func (q *ShmQ) IsFull() bool {
+	rd, wr := q.load()
+	return qfull(rd, wr, q.mask+1)
+}
+
+// Len returns the number of records in the queue
+func (q *ShmQ) Len() int {
+	rd, wr := q.load()
+	return qlen(rd, wr)
+}
+
+// Size returns the capacity of the queue
+func (q *ShmQ) Size() int {
+	return int(q.mask + 1) //#nosec G115 -- 64-bit platforms
+}
+
+// RecSize returns the size of each record
+func (q *ShmQ) RecSize() int {
+	return int(q.recsz) //#nosec G115 -- 64-bit platforms
+}
+
+// String returns a human readable description of the queue
+func (q *ShmQ) String() string {
+	rd, wr := q.load()
+	suff := qrepr(rd, wr, q.mask+1)
+
+	return fmt.Sprintf("<ShmQ %s recsz=%d %s>", q.fd.Name(), q.recsz, suff)
+}
+
+// load returns a consistent looking snapshot of the rd, wr counters
+func (q *ShmQ) load() (uint64, uint64) {
+	// read 'rd' first so that 'wr' is never behind it
+	rd := q.rd.Load()
+	wr := q.wr.Load()
+	if wr-rd > q.mask+1 {
+		wr = rd + q.mask + 1
+	}
+	return rd, wr
+}
+
+func (q *ShmQ) rec(i uint64) []byte {
+	off := i * q.recsz
+	return q.data[off : off+q.recsz]
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
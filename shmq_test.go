@@ -0,0 +1,141 @@
+// shmq_test.go - tests for the shared memory queue
+
+//go:build unix
+
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const (
+	shmTestRecSize = 24
+	shmTestSlots   = 64
+	shmTestIters   = 50_000
+)
+
+func TestShmQ(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := filepath.Join(t.TempDir(), "q")
+	p, err := CreateShmQ(fn, 16, 3)
+	assert(err == nil, "create: %v", err)
+	defer p.Close()
+
+	c, err := OpenShmQ(fn, 16, 3)
+	assert(err == nil, "open: %v", err)
+	defer c.Close()
+
+	assert(c.Size() == 4, "size: exp 4, saw %d", c.Size())
+	assert(c.IsEmpty(), "expected q to be empty")
+
+	buf := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		ok := p.Enq([]byte{byte(i), 1, 2})
+		assert(ok, "enq-%d failed", i)
+	}
+	assert(!p.Enq([]byte{9}), "expected q full\n%s", p)
+	assert(c.IsFull(), "expected q full\n%s", c)
+
+	// wrap around a few times
+	for i := 0; i < 20; i++ {
+		ok := c.Deq(buf)
+		assert(ok, "deq-%d failed", i)
+		assert(buf[0] == byte(i) && buf[2] == 2 && buf[3] == 0, "deq-%d: saw %v", i, buf)
+
+		ok = p.Enq([]byte{byte(i + 4), 1, 2})
+		assert(ok, "enq-%d failed", i+4)
+	}
+	assert(c.Len() == 4, "len: exp 4, saw %d", c.Len())
+
+	_, err = OpenShmQ(fn, 8, 3)
+	assert(errors.Is(err, ErrShmMismatch), "open: exp mismatch, saw %v", err)
+	_, err = OpenShmQ(fn, 16, 8)
+	assert(errors.Is(err, ErrShmMismatch), "open: exp mismatch, saw %v", err)
+}
+
+// TestShmQProcess runs the producer in a child process
+func TestShmQProcess(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "q")
+	q, err := CreateShmQ(fn, shmTestRecSize, shmTestSlots)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	defer q.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShmQChild$")
+	cmd.Env = append(os.Environ(), "SHMQ_TEST_PATH="+fn)
+	out, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatalf("tmp: %s", err)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("exec: %s", err)
+	}
+
+	buf := make([]byte, shmTestRecSize)
+	deadline := time.Now().Add(time.Minute)
+	for i := uint64(0); i < shmTestIters; {
+		if !q.Deq(buf) {
+			if time.Now().After(deadline) {
+				cmd.Process.Kill()
+				break
+			}
+			runtime.Gosched()
+			continue
+		}
+
+		a := binary.LittleEndian.Uint64(buf[0:])
+		b := binary.LittleEndian.Uint64(buf[8:])
+		if a != i || b != ^i {
+			t.Fatalf("deq: exp %d, saw %d/%x", i, a, b)
+		}
+		i++
+	}
+
+	if err := cmd.Wait(); err != nil {
+		b, _ := os.ReadFile(out.Name())
+		t.Fatalf("child: %s\n%s", err, b)
+	}
+	if !q.IsEmpty() {
+		t.Fatalf("expected q to be empty\n%s", q)
+	}
+}
+
+// TestShmQChild is the producer for TestShmQProcess
+func TestShmQChild(t *testing.T) {
+	fn := os.Getenv("SHMQ_TEST_PATH")
+	if len(fn) == 0 {
+		t.Skip("only runs as a child of TestShmQProcess")
+	}
+
+	q, err := OpenShmQ(fn, shmTestRecSize, shmTestSlots)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer q.Close()
+
+	buf := make([]byte, shmTestRecSize)
+	deadline := time.Now().Add(time.Minute)
+	for i := uint64(0); i < shmTestIters; {
+		binary.LittleEndian.PutUint64(buf[0:], i)
+		binary.LittleEndian.PutUint64(buf[8:], ^i)
+		if !q.Enq(buf) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out at %d", i)
+			}
+			runtime.Gosched()
+			continue
+		}
+		i++
+	}
+}
@@ -10,13 +10,16 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"iter"
 	"sync/atomic"
+	"time"
 )
 
 // SPSCQ[T] is a generic & bounded single-producer/single-consumer
 // queue. This queue always has a power-of-2 size. For a queue
-// with capacity 'N', it will store N-1 elements.
+// with capacity 'N', it will store N elements.
 type SPSCQ[T any] struct {
 	rd atomic.Uint64
 	_  [7]uint64 // cache-line pad
@@ -30,29 +33,40 @@ type SPSCQ[T any] struct {
 	wrc uint64    // write-index cached
 	_   [7]uint64 // cache-line pad
 
-	mask uint64
-	q    []T
+	mask   uint64
+	q      []T
+	st     *spscStats // nil unless stats are enabled
+	pol    qPolicy[T]
+	sig    bool // the wait strategy must be signalled
+	closed atomic.Bool
 }
 
 // Make a new SPSC-Q to hold at-least 'n' elements. If 'n'
 // is not a power-of-2, this function will pick the next
-// closest power-of-2.
-func NewSPSCQ[T any](n int) *SPSCQ[T] {
-	return newSPSCQ[T](n)
+// closest power-of-2. The DropOldest policy is not supported.
+func NewSPSCQ[T any](n int, opts ...QOption[T]) *SPSCQ[T] {
+	return newSPSCQ(n, opts)
 }
 
 // NewSPSCQFrom makes a new SPSC-Q with the contents from the initial
 // list 'v'
-func NewSPSCQFrom[T any](v []T) *SPSCQ[T] {
-	q := newSPSCQ[T](len(v))
+func NewSPSCQFrom[T any](v []T, opts ...QOption[T]) *SPSCQ[T] {
+	q := newSPSCQ(len(v), opts)
 
-	n := copy(q.q[1:], v)
+	n := copy(q.q, v)
 	q.wr.Store(uint64(n)) //#nosec G115 -- 64 bit platforms
 	return q
 }
 
-func newSPSCQ[T any](n int) *SPSCQ[T] {
-	q := &SPSCQ[T]{}
+func newSPSCQ[T any](n int, opts []QOption[T]) *SPSCQ[T] {
+	q := &SPSCQ[T]{
+		pol: newPolicy("SPSCQ", opts, DropOldest),
+	}
+	if q.pol.wait == nil {
+		q.pol.wait = NewSpinYield(DefaultSpins)
+	}
+	q.sig = signals(q.pol.wait)
+
 	z := nextpow2(uint64(n)) //#nosec G115 -- 64-bit platforms no overflow
 
 	q.mask = z - 1
@@ -68,19 +82,53 @@ func (q *SPSCQ[T]) Flush() {
 	q.wr.Store(0)
 	q.rdc = 0
 	q.wrc = 0
+	q.signal()
 }
 
-// Enq enqueues a new element. Returns true on success
-// and false when Q is full.
+// Enq enqueues a new element; if the queue is full, the queue
+// policy decides the outcome. Returns true on success and false
+// when the element was not enqueued or the queue is closed.
 func (q *SPSCQ[T]) Enq(x T) bool {
-	wr := (1 + q.wr.Load()) & q.mask
-	if wr == q.rdc {
-		if q.rdc = q.rd.Load(); wr == q.rdc {
-			return false
+	if q.pol.policy == Block {
+		return q.EnqWait(context.Background(), x) == nil
+	}
+
+	if q.closed.Load() {
+		return false
+	}
+	if !q.put(x) {
+		q.pol.dropped(x)
+		return false
+	}
+	return true
+}
+
+// put enqueues a new element; returns false if the queue is full
+func (q *SPSCQ[T]) put(x T) bool {
+	wr := q.wr.Load()
+	if !q.room(wr) {
+		if q.st != nil {
+			q.st.enqFull.Add(1)
 		}
+		return false
+	}
+
+	q.q[wr&q.mask] = x
+	if q.st != nil {
+		q.enqueued(1, wr+1)
+	}
+	q.wr.Store(wr + 1)
+	q.signal()
+	return true
+}
+
+// room returns true if the producer can write to the slot 'wr'; it
+// refreshes the cached read index only when the queue looks full.
+func (q *SPSCQ[T]) room(wr uint64) bool {
+	if qfull(q.rdc, wr, uint64(len(q.q))) {
+		q.rdc = q.rd.Load()
+		return !qfull(q.rdc, wr, uint64(len(q.q)))
 	}
-	q.q[wr] = x
-	q.wr.Store(wr)
 	return true
 }
 
@@ -90,48 +138,391 @@ func (q *SPSCQ[T]) Deq() (T, bool) {
 	rd := q.rd.Load()
 	if rd == q.wrc {
 		if q.wrc = q.wr.Load(); rd == q.wrc {
+			if q.st != nil {
+				q.st.deqEmpty.Add(1)
+			}
 			var z T
 			return z, false
 		}
 	}
 
-	rd = (1 + rd) & q.mask
-	z := q.q[rd]
-	q.rd.Store(rd)
+	z := q.q[rd&q.mask]
+	if q.st != nil {
+		q.st.deq.Add(1)
+	}
+	q.rd.Store(rd + 1)
+	q.signal()
 	return z, true
 }
 
-// IsEmpty returns true if the queue is empty
-func (q *SPSCQ[T]) IsEmpty() bool {
+// Reserve returns a pointer to the next free slot in the queue so
+// that the producer can fill it in place; it returns false if the
+// queue is full or closed. The slot is not visible to the consumer
+// until the producer calls Commit(). The producer must not call Enq
+// or EnqN between Reserve and Commit.
+func (q *SPSCQ[T]) Reserve() (*T, bool) {
+	if q.closed.Load() {
+		return nil, false
+	}
+
+	wr := q.wr.Load()
+	if !q.room(wr) {
+		if q.st != nil {
+			q.st.enqFull.Add(1)
+		}
+		return nil, false
+	}
+	return &q.q[wr&q.mask], true
+}
+
+// Commit publishes the slot returned by the preceding successful
+// call to Reserve.
+func (q *SPSCQ[T]) Commit() {
+	wr := 1 + q.wr.Load()
+	q.wr.Store(wr)
+	q.signal()
+	if q.st != nil {
+		q.enqueued(1, wr)
+	}
+}
+
+// Peek returns a pointer to the oldest element in the queue so that
+// the consumer can read it in place; it returns false if the queue
+// is empty. The slot remains owned by the consumer until it calls
+// Release(). The consumer must not call Deq or DeqN between Peek and
+// Release.
+func (q *SPSCQ[T]) Peek() (*T, bool) {
 	rd := q.rd.Load()
+	if rd == q.wrc {
+		if q.wrc = q.wr.Load(); rd == q.wrc {
+			if q.st != nil {
+				q.st.deqEmpty.Add(1)
+			}
+			return nil, false
+		}
+	}
+	return &q.q[rd&q.mask], true
+}
+
+// Release returns the slot obtained by the preceding successful
+// call to Peek back to the producer.
+func (q *SPSCQ[T]) Release() {
+	q.rd.Store(1 + q.rd.Load())
+	q.signal()
+	if q.st != nil {
+		q.st.deq.Add(1)
+	}
+}
+
+// EnqN enqueues as many elements of 'v' as will fit in the queue
+// and returns the number of elements enqueued. The write index is
+// published once for the entire batch. EnqN returns 0 if the queue
+// is closed.
+func (q *SPSCQ[T]) EnqN(v []T) int {
+	if q.closed.Load() {
+		return 0
+	}
+
 	wr := q.wr.Load()
-	return qempty(rd, wr, q.mask)
+	sz := uint64(len(q.q))
+	free := sz - (wr - q.rdc)
+	if free < uint64(len(v)) {
+		q.rdc = q.rd.Load()
+		free = sz - (wr - q.rdc)
+	}
+
+	n := min(uint64(len(v)), free)
+	if q.st != nil && n < uint64(len(v)) {
+		q.st.enqFull.Add(1)
+	}
+	if n == 0 {
+		return 0
+	}
+
+	// the batch may straddle the end of the ring
+	i := wr & q.mask
+	k := copy(q.q[i:], v[:n])
+	copy(q.q, v[k:n])
+
+	wr += n
+	q.wr.Store(wr)
+	q.signal()
+	if q.st != nil {
+		q.enqueued(n, wr)
+	}
+	return int(n) //#nosec G115 -- n <= len(v)
+}
+
+// DeqN dequeues up to len(v) elements into 'v' and returns the
+// number of elements dequeued. The read index is published once
+// for the entire batch.
+func (q *SPSCQ[T]) DeqN(v []T) int {
+	if len(v) == 0 {
+		return 0
+	}
+
+	rd := q.rd.Load()
+	avail := q.wrc - rd
+	if avail < uint64(len(v)) {
+		q.wrc = q.wr.Load()
+		avail = q.wrc - rd
+	}
+
+	n := min(uint64(len(v)), avail)
+	if n == 0 {
+		if q.st != nil {
+			q.st.deqEmpty.Add(1)
+		}
+		return 0
+	}
+
+	i := rd & q.mask
+	k := copy(v[:n], q.q[i:])
+	copy(v[k:n], q.q)
+
+	q.rd.Store(rd + n)
+	q.signal()
+	if q.st != nil {
+		q.st.deq.Add(n)
+	}
+	return int(n) //#nosec G115 -- n <= len(v)
+}
+
+// EnqErr is like Enq but returns ErrFull if the queue is full and
+// ErrClosed if the queue is closed.
+func (q *SPSCQ[T]) EnqErr(x T) error {
+	if q.closed.Load() {
+		return ErrClosed
+	}
+	if !q.put(x) {
+		return ErrFull
+	}
+	return nil
+}
+
+// DeqErr is like Deq but returns ErrEmpty if the queue is empty and
+// ErrClosed if the queue is closed and empty.
+func (q *SPSCQ[T]) DeqErr() (T, error) {
+	if x, ok := q.Deq(); ok {
+		return x, nil
+	}
+
+	if q.closed.Load() {
+		// elements enqueued before Close() must still be delivered
+		x, ok := q.Deq()
+		if ok {
+			return x, nil
+		}
+		return x, ErrClosed
+	}
+
+	var z T
+	return z, ErrEmpty
+}
+
+// blocks returns true if Enq blocks on a full queue
+func (q *SPSCQ[T]) blocks() bool {
+	return q.pol.policy == Block
+}
+
+// EnqWait enqueues a new element to the queue; if the queue is full,
+// the producer waits using the wait strategy of the queue until there
+// is room or the context is done. It returns nil on success,
+// ErrClosed if the queue is closed and the context error otherwise.
+func (q *SPSCQ[T]) EnqWait(ctx context.Context, x T) error {
+	for {
+		if q.closed.Load() {
+			return ErrClosed
+		}
+		if q.put(x) {
+			return nil
+		}
+
+		err := q.pol.wait.Wait(ctx, func() bool {
+			return q.closed.Load() || !q.IsFull()
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DeqWait dequeues an element from the queue; if the queue is empty,
+// the consumer waits using the wait strategy of the queue until an
+// element is available or the context is done. It returns ErrClosed
+// if the queue is closed and empty and the context error if the
+// context is done first.
+func (q *SPSCQ[T]) DeqWait(ctx context.Context) (T, error) {
+	for {
+		x, err := q.DeqErr()
+		if err != ErrEmpty {
+			return x, err
+		}
+
+		err = q.pol.wait.Wait(ctx, func() bool {
+			return q.closed.Load() || !q.IsEmpty()
+		})
+		if err != nil {
+			return x, err
+		}
+	}
+}
+
+// EnqTimeout is like EnqWait but gives up after duration 'd'.
+// It returns context.DeadlineExceeded on timeout.
+func (q *SPSCQ[T]) EnqTimeout(x T, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.EnqWait(ctx, x)
+}
+
+// DeqTimeout is like DeqWait but gives up after duration 'd'.
+// It returns context.DeadlineExceeded on timeout.
+func (q *SPSCQ[T]) DeqTimeout(d time.Duration) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.DeqWait(ctx)
+}
+
+// Close closes the queue for new elements: subsequent enqueues fail
+// and EnqErr returns ErrClosed. The consumer can continue to dequeue
+// the remaining elements; once the queue is empty, DeqErr returns
+// ErrClosed. Close is typically called by the producer; closing a
+// closed queue returns ErrClosed.
+func (q *SPSCQ[T]) Close() error {
+	if q.closed.Swap(true) {
+		return ErrClosed
+	}
+	q.signal()
+	return nil
+}
+
+// IsClosed returns true if the queue is closed
+func (q *SPSCQ[T]) IsClosed() bool {
+	return q.closed.Load()
+}
+
+// signal tells the wait strategy that the queue changed state; it
+// only pays for the call if the strategy can have a parked waiter.
+func (q *SPSCQ[T]) signal() {
+	if q.sig {
+		q.pol.wait.Signal()
+	}
+}
+
+// idles returns true if DeqWait gives up the CPU while it waits
+func (q *SPSCQ[T]) idles() bool {
+	return idles(q.pol.wait)
+}
+
+// notify returns a channel that is closed when the queue is not empty
+// or closed; it returns nil if the wait strategy can't notify (only
+// SpinPark can). It returns true if the queue is closed and empty.
+// Each call must be paired with unnotify.
+func (q *SPSCQ[T]) notify() (<-chan struct{}, bool) {
+	var ch <-chan struct{}
+	if sp, ok := q.pol.wait.(*SpinPark); ok {
+		ch = sp.watch()
+	}
+
+	// the producer publishes its last element before closing
+	switch {
+	case q.closed.Load():
+		if q.IsEmpty() {
+			return nil, true
+		}
+		return closedch, false
+	case !q.IsEmpty():
+		return closedch, false
+	}
+	return ch, false
+}
+
+// unnotify ends a wait started by notify
+func (q *SPSCQ[T]) unnotify() {
+	if sp, ok := q.pol.wait.(*SpinPark); ok {
+		sp.unwatch()
+	}
+}
+
+// Drain returns an iterator that dequeues each element of the queue
+// until it is empty. Drain must only be used by the consumer.
+func (q *SPSCQ[T]) Drain() iter.Seq[T] {
+	return drain(q.Deq)
+}
+
+// EnableStats turns on the collection of runtime statistics for
+// this queue. It must be called before the queue is shared between
+// the producer and the consumer.
+func (q *SPSCQ[T]) EnableStats() {
+	if q.st == nil {
+		q.st = &spscStats{}
+	}
+}
+
+// Err returns ErrFull if an Enq was rejected under the Error policy
+// since the last call to Err and nil otherwise; use EnqErr for the
+// outcome of a single enqueue. Err is safe to call from any go-routine.
+func (q *SPSCQ[T]) Err() error {
+	return q.pol.err()
+}
+
+// syncStats marks SPSCQ as a SyncStatsProvider
+func (q *SPSCQ[T]) syncStats() {}
+
+// Stats returns a snapshot of the runtime statistics of this queue;
+// the statistics are all zero if they were never enabled. Stats is
+// safe to call from any go-routine.
+func (q *SPSCQ[T]) Stats() QStats {
+	if q.st == nil {
+		return QStats{}
+	}
+	return q.st.snapshot()
+}
+
+// enqueued records 'k' enqueues that moved the write index to 'wr'
+func (q *SPSCQ[T]) enqueued(k, wr uint64) {
+	q.st.enqueued(k, wr-q.rd.Load())
+}
+
+// IsEmpty returns true if the queue is empty
+func (q *SPSCQ[T]) IsEmpty() bool {
+	rd, wr := q.load()
+	return qempty(rd, wr)
 }
 
 // IsFull returns true if the queue is full
 func (q *SPSCQ[T]) IsFull() bool {
-	rd := q.rd.Load()
-	wr := q.wr.Load()
-	return qfull(rd, wr, q.mask)
+	rd, wr := q.load()
+	return qfull(rd, wr, uint64(len(q.q)))
 }
 
 // Len returns the number of elements in the queue
 func (q *SPSCQ[T]) Len() int {
-	rd := q.rd.Load()
-	wr := q.wr.Load()
-	return qlen(rd, wr, q.mask)
+	rd, wr := q.load()
+	return qlen(rd, wr)
 }
 
 // Size returns the capacity of the queue
 func (q *SPSCQ[T]) Size() int {
-	// Due to the q-full and q-empty conditions, we will
-	// always have one unused slot.
-	return len(q.q) - 1
+	return len(q.q)
 }
 
 // String returns a human readable description of the queue
 func (q *SPSCQ[T]) String() string {
-	suff := qrepr(q.rd.Load(), q.wr.Load(), q.mask)
+	rd, wr := q.load()
+	suff := qrepr(rd, wr, uint64(len(q.q)))
 
 	return fmt.Sprintf("<SPSCQ %T %s>", q, suff)
 }
+
+// load returns a consistent looking snapshot of the rd, wr counters
+func (q *SPSCQ[T]) load() (uint64, uint64) {
+	// read 'rd' first so that 'wr' is never behind it
+	rd := q.rd.Load()
+	wr := q.wr.Load()
+	if wr-rd > uint64(len(q.q)) {
+		wr = rd + uint64(len(q.q))
+	}
+	return rd, wr
+}
@@ -10,7 +10,9 @@
 package utils
 
 import (
+	"errors"
 	"math/rand/v2"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -32,6 +34,9 @@ func TestSPSCFunctionality(t *testing.T) {
 	assert(ok, "can't enq 300")
 
 	ok = q.Enq(400)
+	assert(ok, "can't enq 400")
+
+	ok = q.Enq(500)
 	assert(!ok, "expected q full\n%s", q)
 
 	z, ok = q.Deq()
@@ -43,11 +48,178 @@ func TestSPSCFunctionality(t *testing.T) {
 	z, ok = q.Deq()
 	assert(ok, "can't deq 300")
 	assert(z == 300, "exp 300, saw %d", z)
+	z, ok = q.Deq()
+	assert(ok, "can't deq 400")
+	assert(z == 400, "exp 400, saw %d", z)
 
 	_, ok = q.Deq()
 	assert(!ok, "expected q empty\n%s", q)
 }
 
+func TestSPSCBatch(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSPSCQ[int](7)
+	assert(q.Size() == 8, "size: exp 8, saw %d", q.Size())
+
+	v := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	n := q.EnqN(v)
+	assert(n == 8, "enqn: exp 8, saw %d", n)
+	assert(q.IsFull(), "expected q full\n%s", q)
+
+	n = q.EnqN(v)
+	assert(n == 0, "enqn: exp 0, saw %d", n)
+
+	out := make([]int, 5)
+	n = q.DeqN(out)
+	assert(n == 5, "deqn: exp 5, saw %d", n)
+	for i := 0; i < n; i++ {
+		assert(out[i] == v[i], "deqn %d: exp %d, saw %d", i, v[i], out[i])
+	}
+
+	// this batch will wrap around the end of the ring
+	n = q.EnqN(v[8:])
+	assert(n == 2, "enqn: exp 2, saw %d", n)
+	assert(q.Len() == 5, "len: exp 5, saw %d", q.Len())
+
+	out = make([]int, 10)
+	n = q.DeqN(out)
+	assert(n == 5, "deqn: exp 5, saw %d", n)
+	for i := 0; i < n; i++ {
+		assert(out[i] == v[i+5], "deqn %d: exp %d, saw %d", i, v[i+5], out[i])
+	}
+
+	assert(q.IsEmpty(), "expected q empty\n%s", q)
+	n = q.DeqN(out)
+	assert(n == 0, "deqn: exp 0, saw %d", n)
+
+	// interleave single and batch ops across many wraps
+	var wr, rd int
+	for i := 0; i < 100; i++ {
+		if q.Enq(wr) {
+			wr++
+		}
+		b := []int{wr, wr + 1, wr + 2}
+		wr += q.EnqN(b)
+
+		z, ok := q.Deq()
+		assert(ok, "deq %d: failed", rd)
+		assert(z == rd, "deq: exp %d, saw %d", rd, z)
+		rd++
+
+		n := q.DeqN(out[:2])
+		for j := 0; j < n; j++ {
+			assert(out[j] == rd, "deqn: exp %d, saw %d", rd, out[j])
+			rd++
+		}
+	}
+}
+
+type pkt struct {
+	seq uint64
+	buf [4096]byte
+}
+
+func TestSPSCReserve(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSPSCQ[pkt](3)
+
+	_, ok := q.Peek()
+	assert(!ok, "expected q empty\n%s", q)
+
+	for i := 0; i < q.Size(); i++ {
+		p, ok := q.Reserve()
+		assert(ok, "reserve %d failed", i)
+		p.seq = uint64(i) //#nosec G115 -- test
+		p.buf[i] = byte(i)
+		q.Commit()
+	}
+
+	_, ok = q.Reserve()
+	assert(!ok, "expected q full\n%s", q)
+	assert(q.IsFull(), "expected q full\n%s", q)
+
+	// wrap around a few times
+	var rd uint64
+	for i := q.Size(); i < 100; i++ {
+		p, ok := q.Peek()
+		assert(ok, "peek %d failed", rd)
+		assert(p.seq == rd, "peek: exp %d, saw %d", rd, p.seq)
+		assert(p.buf[rd%4096] == byte(rd), "peek %d: buf mismatch", rd)
+		q.Release()
+		rd++
+
+		p, ok = q.Reserve()
+		assert(ok, "reserve %d failed", i)
+		p.seq = uint64(i) //#nosec G115 -- test
+		p.buf[i%4096] = byte(i)
+		q.Commit()
+	}
+
+	for !q.IsEmpty() {
+		z, ok := q.Deq()
+		assert(ok, "deq %d failed", rd)
+		assert(z.seq == rd, "deq: exp %d, saw %d", rd, z.seq)
+		rd++
+	}
+	assert(rd == 100, "exp 100 elements, saw %d", rd)
+}
+
+func TestSPSCReserveConcurrency(t *testing.T) {
+	const iters = 100_000
+
+	q := NewSPSCQ[pkt](64)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); i < iters; {
+			p, ok := q.Reserve()
+			if !ok {
+				runtime.Gosched()
+				continue
+			}
+			p.seq = i
+			p.buf[i%4096] = byte(i)
+			q.Commit()
+			i++
+		}
+	}()
+
+	for i := uint64(0); i < iters; {
+		p, ok := q.Peek()
+		if !ok {
+			runtime.Gosched()
+			continue
+		}
+		if p.seq != i || p.buf[i%4096] != byte(i) {
+			t.Fatalf("exp %d, saw %d", i, p.seq)
+		}
+		q.Release()
+		i++
+	}
+	wg.Wait()
+}
+
+func TestSPSCDrain(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSPSCQ[int](8)
+	for i := 0; i < 5; i++ {
+		assert(q.Enq(i), "enq-%d failed", i)
+	}
+
+	var n int
+	for x := range q.Drain() {
+		assert(x == n, "drain: exp %d, saw %d", n, x)
+		n++
+	}
+	assert(n == 5, "drain: exp 5 elements, saw %d", n)
+	assert(q.IsEmpty(), "expected q empty\n%s", q)
+}
+
 type myQ struct {
 	q *SPSCQ[uint64]
 
@@ -64,6 +236,79 @@ type myQ struct {
 	wg sync.WaitGroup
 }
 
+// TestSPSCClose checks that Close fails the producer side right away
+// and that the consumer drains the queue before it sees ErrClosed.
+func TestSPSCClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSPSCQ[int](4)
+	_, err := q.DeqErr()
+	assert(errors.Is(err, ErrEmpty), "deq: exp ErrEmpty, saw %v", err)
+
+	n := 0
+	for q.EnqErr(n) == nil {
+		n++
+	}
+	err = q.EnqErr(n)
+	assert(errors.Is(err, ErrFull), "enq: exp ErrFull, saw %v", err)
+
+	z, err := q.DeqErr()
+	assert(err == nil && z == 0, "deq: exp 0, saw %d %v", z, err)
+
+	assert(q.Close() == nil, "close failed")
+	assert(q.IsClosed(), "not closed")
+	assert(errors.Is(q.Close(), ErrClosed), "double close: exp ErrClosed")
+
+	err = q.EnqErr(100)
+	assert(errors.Is(err, ErrClosed), "enq: exp ErrClosed, saw %v", err)
+	assert(q.EnqN([]int{1, 2}) == 0, "enqn after close succeeded")
+	_, ok := q.Reserve()
+	assert(!ok, "reserve after close succeeded")
+
+	for i := 1; i < n; i++ {
+		z, err := q.DeqErr()
+		assert(err == nil, "deq-%d: %v", i, err)
+		assert(z == i, "deq: exp %d, saw %d", i, z)
+	}
+	_, err = q.DeqErr()
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+}
+
+// TestSPSCCloseConcurrency has the producer close the queue after its
+// last element; the consumer must see every element before ErrClosed.
+func TestSPSCCloseConcurrency(t *testing.T) {
+	assert := newAsserter(t)
+
+	const N = 10000
+	q := NewSPSCQ[int](64)
+
+	go func() {
+		for i := 0; i < N; {
+			if q.Enq(i) {
+				i++
+			} else {
+				runtime.Gosched()
+			}
+		}
+		q.Close()
+	}()
+
+	var n int
+	for {
+		z, err := q.DeqErr()
+		if errors.Is(err, ErrClosed) {
+			break
+		}
+		if err != nil {
+			runtime.Gosched()
+			continue
+		}
+		assert(z == n, "deq: exp %d, saw %d", n, z)
+		n++
+	}
+	assert(n == N, "exp %d elements, saw %d", N, n)
+}
+
 // TestSPSCWrapAround ensures the ring buffer indices cycle correctly
 // without crashing or losing data when they exceed the array size.
 func TestSPSCWrapAround(t *testing.T) {
@@ -222,3 +467,78 @@ func TestSPSCConcurrency(t *testing.T) {
 			qsize, iters, pc, cc, myq.errs)
 	}
 }
+
+func TestSPSCBatchConcurrency(t *testing.T) {
+	const batch = 64
+
+	enq := func(myq *myQ, n uint64) {
+		myq.b.Wait()
+
+		var v uint64
+		var buf [batch]uint64
+
+		q := myq.q
+		start := time.Now()
+		for v < n {
+			m := min(n-v, batch)
+			for i := range m {
+				buf[i] = v + i
+			}
+			k := q.EnqN(buf[:m])
+			if k == 0 {
+				runtime.Gosched()
+			}
+			v += uint64(k) //#nosec G115 -- k <= batch
+		}
+
+		myq.prod = time.Since(start)
+		myq.wg.Done()
+	}
+
+	deq := func(myq *myQ, n uint64) {
+		myq.b.Wait()
+
+		var v uint64
+		var err uint64
+		var buf [batch]uint64
+
+		q := myq.q
+		start := time.Now()
+		for v < n {
+			m := q.DeqN(buf[:])
+			if m == 0 {
+				runtime.Gosched()
+			}
+			for _, z := range buf[:m] {
+				if v != z {
+					err++
+				}
+				v++
+			}
+		}
+
+		myq.cons = time.Since(start)
+		myq.errs = err
+		myq.wg.Done()
+	}
+
+	const iters uint64 = 10 * 1048576
+	for _, qsize := range qsizes {
+		myq := newQ(qsize)
+
+		myq.wg.Add(2)
+		go enq(myq, iters)
+		go deq(myq, iters)
+
+		myq.b.Broadcast()
+		myq.wg.Wait()
+
+		pc := float64(myq.prod) / float64(iters)
+		cc := float64(myq.cons) / float64(iters)
+		t.Logf("Q size %6d: %d items; batch %d; P %4.2f ns/item, C %4.2f ns/item (errs %d)\n",
+			qsize, iters, batch, pc, cc, myq.errs)
+		if myq.errs > 0 {
+			t.Fatalf("Q size %d: %d sequence errors", qsize, myq.errs)
+		}
+	}
+}
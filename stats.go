@@ -0,0 +1,93 @@
+// stats.go - Runtime statistics for the queues
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// QStats is a snapshot of the runtime statistics of a queue.
+// Statistics are opt-in: each queue type has an EnableStats() method
+// and has no overhead until it is called.
+type QStats struct {
+	Enq       uint64 // number of successful enqueues
+	Deq       uint64 // number of successful dequeues
+	EnqFull   uint64 // number of enqueues that failed due to a full queue
+	DeqEmpty  uint64 // number of dequeues that failed due to an empty queue
+	Evicted   uint64 // number of elements evicted by DropOldest or a ring
+	HighWater int    // highest queue length seen
+	Contended uint64 // number of contended lock acquisitions (SyncQ only)
+}
+
+// StatsProvider is implemented by queues that keep runtime statistics
+type StatsProvider interface {
+	Stats() QStats
+}
+
+// SyncStatsProvider is a StatsProvider whose Stats method is safe to
+// call from any go-routine: SyncQ, SyncRing and SPSCQ. The stats of
+// Q, DynQ and Ring can only be read by their owner.
+type SyncStatsProvider interface {
+	StatsProvider
+
+	// syncStats marks the thread-safe queues
+	syncStats()
+}
+
+// PublishStats publishes the runtime statistics of 'q' as the expvar
+// variable 'name'. The expvar handler reads the stats from its own
+// go-routine; hence only thread-safe queues can be published. Like
+// expvar.Publish, it panics if 'name' is already in use.
+func PublishStats(name string, q SyncStatsProvider) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return q.Stats()
+	}))
+}
+
+// enq records a successful enqueue that resulted in a queue of
+// length 'n'
+func (s *QStats) enq(n int) {
+	s.Enq++
+	s.HighWater = max(s.HighWater, n)
+}
+
+// spscStats are the runtime statistics of a SPSCQ; the producer and
+// consumer counters are on separate cache lines.
+type spscStats struct {
+	enq     atomic.Uint64
+	enqFull atomic.Uint64
+	hwm     atomic.Uint64
+	_       [5]uint64 // cache-line pad
+
+	deq      atomic.Uint64
+	deqEmpty atomic.Uint64
+}
+
+// enqueued records 'k' successful enqueues that resulted in a queue of
+// length 'n'; it must only be called by the producer.
+func (s *spscStats) enqueued(k, n uint64) {
+	s.enq.Add(k)
+	if n > s.hwm.Load() {
+		s.hwm.Store(n)
+	}
+}
+
+func (s *spscStats) snapshot() QStats {
+	return QStats{
+		Enq:       s.enq.Load(),
+		Deq:       s.deq.Load(),
+		EnqFull:   s.enqFull.Load(),
+		DeqEmpty:  s.deqEmpty.Load(),
+		HighWater: int(s.hwm.Load()), //#nosec G115 -- bounded by the queue size
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,203 @@
+// stats_test.go - tests for queue statistics
+
+package utils
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewQ[int](3)
+	q.Enq(1)
+
+	st := q.Stats()
+	assert(st == QStats{}, "stats: exp zero, saw %+v", st)
+
+	q.EnableStats()
+	for i := 0; i < 4; i++ {
+		q.Enq(i)
+	}
+	q.Deq()
+	q.PushFront(9)
+	q.PopBack()
+	q.Deq()
+	q.Deq()
+	q.Deq()
+	q.Deq()
+
+	st = q.Stats()
+	exp := QStats{Enq: 4, Deq: 5, EnqFull: 1, DeqEmpty: 1, HighWater: 4}
+	assert(st == exp, "stats: exp %+v, saw %+v", exp, st)
+}
+
+func TestSyncQStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	const (
+		nprod = 4
+		iters = 1000
+	)
+
+	q := NewSyncQ[int](16)
+	q.EnableStats()
+
+	var wg sync.WaitGroup
+	wg.Add(nprod)
+	for i := 0; i < nprod; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iters; j++ {
+				q.Enq(j)
+				q.Deq()
+			}
+		}()
+	}
+	wg.Wait()
+
+	st := q.Stats()
+	assert(st.Enq+st.EnqFull == nprod*iters, "stats: enq mismatch %+v", st)
+	assert(st.Deq+st.DeqEmpty == nprod*iters, "stats: deq mismatch %+v", st)
+	assert(st.Enq == st.Deq, "stats: enq != deq %+v", st)
+	assert(st.HighWater > 0 && st.HighWater <= q.Size(), "stats: bad highwater %+v", st)
+	t.Logf("%+v", st)
+}
+
+func TestEvictStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	// evictions are not dequeues
+	q := NewSyncQ(2, WithPolicy[int](DropOldest))
+	q.EnableStats()
+	for i := 0; i < 5; i++ {
+		q.Enq(i)
+	}
+	q.Deq()
+
+	st := q.Stats()
+	exp := QStats{Enq: 5, Deq: 1, EnqFull: 3, Evicted: 3, HighWater: 2}
+	assert(st == exp, "drop-oldest: exp %+v, saw %+v", exp, st)
+
+	r := NewRing[int](2)
+	r.EnableStats()
+	for i := 0; i < 5; i++ {
+		r.Enq(i)
+	}
+	st = r.Stats()
+	exp = QStats{Enq: 5, Evicted: 3, HighWater: 2}
+	assert(st == exp, "ring: exp %+v, saw %+v", exp, st)
+}
+
+func TestSPSCStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSPSCQ[int](3)
+	q.EnableStats()
+
+	for i := 0; i < 4; i++ {
+		q.Enq(i)
+	}
+	buf := make([]int, 2)
+	q.DeqN(buf[:0])
+	q.DeqN(buf)
+	q.EnqN([]int{5, 6, 7})
+	q.Peek()
+	q.Release()
+	for range q.Drain() {
+	}
+
+	st := q.Stats()
+	exp := QStats{Enq: 6, Deq: 6, EnqFull: 1, DeqEmpty: 1, HighWater: 4}
+	assert(st == exp, "stats: exp %+v, saw %+v", exp, st)
+}
+
+// expvar names can't be published twice; each run of a test that
+// publishes stats must use a new name (e.g., with go test -count=N).
+var publishSeq atomic.Uint64
+
+func TestPublishStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	q := NewSyncQ[int](4)
+	q.EnableStats()
+	q.Enq(1)
+	q.Enq(2)
+
+	// only the thread-safe queues can be published
+	for _, v := range []any{NewQ[int](4), NewDynQ[int](4), NewRing[int](4)} {
+		_, ok := v.(SyncStatsProvider)
+		assert(!ok, "%T: can be published", v)
+	}
+	var _ SyncStatsProvider = NewSPSCQ[int](4)
+	var _ SyncStatsProvider = NewSyncRing[int](4)
+
+	nm := fmt.Sprintf("%s-%d", t.Name(), publishSeq.Add(1))
+	PublishStats(nm, q)
+
+	v := expvar.Get(nm)
+	assert(v != nil, "expvar: not published")
+
+	var st QStats
+	err := json.Unmarshal([]byte(v.String()), &st)
+	assert(err == nil, "expvar: %v", err)
+	assert(st.Enq == 2 && st.HighWater == 2, "expvar: saw %+v", st)
+}
+
+// the hot paths must not slow down when stats are off
+func BenchmarkQEnqDeq(b *testing.B) {
+	for _, on := range []bool{false, true} {
+		b.Run(statsName(on), func(b *testing.B) {
+			q := NewQ[int](64)
+			if on {
+				q.EnableStats()
+			}
+			for i := 0; i < b.N; i++ {
+				q.Enq(i)
+				q.Deq()
+			}
+		})
+	}
+}
+
+func BenchmarkSyncQEnqDeq(b *testing.B) {
+	for _, on := range []bool{false, true} {
+		b.Run(statsName(on), func(b *testing.B) {
+			q := NewSyncQ[int](64)
+			if on {
+				q.EnableStats()
+			}
+			for i := 0; i < b.N; i++ {
+				q.Enq(i)
+				q.Deq()
+			}
+		})
+	}
+}
+
+func BenchmarkSPSCQEnqDeq(b *testing.B) {
+	for _, on := range []bool{false, true} {
+		b.Run(statsName(on), func(b *testing.B) {
+			q := NewSPSCQ[int](64)
+			if on {
+				q.EnableStats()
+			}
+			for i := 0; i < b.N; i++ {
+				q.Enq(i)
+				q.Deq()
+			}
+		})
+	}
+}
+
+func statsName(on bool) string {
+	if on {
+		return "stats-on"
+	}
+	return "stats-off"
+}
@@ -0,0 +1,262 @@
+// waitstrategy.go - wait strategies for blocking SPSCQ operations
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WaitStrategy decides how a blocked SPSCQ producer or consumer waits
+// for the other side to make progress; this trades latency for CPU
+// usage. Each queue should have its own strategy instance so that
+// Parks() counts the waits of that queue alone.
+type WaitStrategy interface {
+	// Wait blocks until ready() returns true or the context is
+	// done; it returns the context error in the latter case.
+	Wait(ctx context.Context, ready func() bool) error
+
+	// Signal is called after the queue changes state; strategies
+	// that park waiters wake them up here.
+	Signal()
+
+	// Parks returns the number of times a waiter gave up the CPU
+	Parks() uint64
+}
+
+// DefaultSpins is the number of spins of the default SPSCQ wait
+// strategy before it yields the processor.
+const DefaultSpins = 64
+
+// number of spins before checking the context in BusySpin
+const busySpinCheck = 1024
+
+// BusySpin spins on the CPU until the queue is ready; it has the
+// lowest latency and burns a CPU while waiting. It never parks.
+type BusySpin struct{}
+
+// NewBusySpin makes a new busy-spin wait strategy
+func NewBusySpin() *BusySpin {
+	return &BusySpin{}
+}
+
+// Wait spins until ready() returns true or the context is done
+func (w *BusySpin) Wait(ctx context.Context, ready func() bool) error {
+	for i := 1; !ready(); i++ {
+		if i%busySpinCheck == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Signal is a no-op
+func (w *BusySpin) Signal() {}
+
+// Parks always returns 0
+func (w *BusySpin) Parks() uint64 {
+	return 0
+}
+
+// SpinYield spins on the CPU for a while and then yields the
+// processor (runtime.Gosched) between checks. Each yield counts as a
+// park.
+type SpinYield struct {
+	spins int
+	parks atomic.Uint64
+}
+
+// NewSpinYield makes a new wait strategy that spins 'spins' times
+// before it starts yielding the processor.
+func NewSpinYield(spins int) *SpinYield {
+	return &SpinYield{spins: spins}
+}
+
+// Wait spins and then yields until ready() returns true or the
+// context is done.
+func (w *SpinYield) Wait(ctx context.Context, ready func() bool) error {
+	for i := 0; !ready(); i++ {
+		if i < w.spins {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		w.parks.Add(1)
+		runtime.Gosched()
+	}
+	return nil
+}
+
+// Signal is a no-op
+func (w *SpinYield) Signal() {}
+
+// Parks returns the number of times a waiter yielded the processor
+func (w *SpinYield) Parks() uint64 {
+	return w.parks.Load()
+}
+
+// SpinPark spins on the CPU for a while and then parks the waiter
+// until the other side signals a state change. It uses the least CPU
+// at the cost of a wakeup latency; Signal is nearly free when no one
+// is parked. A Selector waits on an SPSCQ with this strategy instead
+// of polling it.
+type SpinPark struct {
+	spins int
+	parks atomic.Uint64
+
+	// number of waiters about to park or parked
+	waiters atomic.Int32
+
+	mu sync.Mutex
+	wq waitq
+}
+
+// NewSpinPark makes a new wait strategy that spins 'spins' times
+// before it parks the waiter.
+func NewSpinPark(spins int) *SpinPark {
+	return &SpinPark{spins: spins}
+}
+
+// Wait spins and then parks until ready() returns true or the
+// context is done.
+func (w *SpinPark) Wait(ctx context.Context, ready func() bool) error {
+	for i := 0; i < w.spins; i++ {
+		if ready() {
+			return nil
+		}
+	}
+
+	for !ready() {
+		// announce the waiter before the final check of ready(); a
+		// Signal() after that check will see the waiter and close
+		// the channel we wait on.
+		ch := w.watch()
+		if ready() {
+			w.unwatch()
+			return nil
+		}
+
+		w.parks.Add(1)
+		select {
+		case <-ch:
+			w.unwatch()
+		case <-ctx.Done():
+			w.unwatch()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// watch registers a waiter and returns a channel that is closed by
+// the next Signal; the caller must check its condition after watch
+// and call unwatch when it stops waiting.
+func (w *SpinPark) watch() <-chan struct{} {
+	w.waiters.Add(1)
+	w.mu.Lock()
+	ch := w.wq.wait()
+	w.mu.Unlock()
+	return ch
+}
+
+// unwatch removes a waiter registered by watch
+func (w *SpinPark) unwatch() {
+	w.waiters.Add(-1)
+}
+
+// Signal wakes up all parked waiters
+func (w *SpinPark) Signal() {
+	if w.waiters.Load() == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	w.wq.wakeup()
+	w.mu.Unlock()
+}
+
+// Parks returns the number of times a waiter was parked
+func (w *SpinPark) Parks() uint64 {
+	return w.parks.Load()
+}
+
+// TimedBackoff sleeps between checks; the sleep starts at a minimum
+// duration and doubles up to a maximum. It uses little CPU and adds
+// up to the maximum sleep to the latency. Each sleep counts as a
+// park.
+type TimedBackoff struct {
+	min, max time.Duration
+	parks    atomic.Uint64
+}
+
+// NewTimedBackoff makes a new wait strategy that sleeps between 'lo'
+// and 'hi' between checks.
+func NewTimedBackoff(lo, hi time.Duration) *TimedBackoff {
+	lo = max(lo, time.Microsecond)
+	return &TimedBackoff{
+		min: lo,
+		max: max(lo, hi),
+	}
+}
+
+// Wait sleeps until ready() returns true or the context is done
+func (w *TimedBackoff) Wait(ctx context.Context, ready func() bool) error {
+	d := w.min
+	for !ready() {
+		w.parks.Add(1)
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		d = min(2*d, w.max)
+	}
+	return nil
+}
+
+// Signal is a no-op
+func (w *TimedBackoff) Signal() {}
+
+// Parks returns the number of times a waiter slept
+func (w *TimedBackoff) Parks() uint64 {
+	return w.parks.Load()
+}
+
+// signals returns false if the Signal method of 'ws' is a no-op; the
+// queue then skips the call on its hot paths.
+func signals(ws WaitStrategy) bool {
+	switch ws.(type) {
+	case *BusySpin, *SpinYield, *TimedBackoff:
+		return false
+	}
+	return true
+}
+
+// idles returns true if a waiter using 'ws' gives up the CPU for
+// long stretches, i.e., it sleeps or parks rather than spinning or
+// yielding.
+func idles(ws WaitStrategy) bool {
+	switch ws.(type) {
+	case *SpinPark, *TimedBackoff:
+		return true
+	}
+	return false
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
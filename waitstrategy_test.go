@@ -0,0 +1,107 @@
+// waitstrategy_test.go - tests for the SPSCQ wait strategies
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testStrategies() map[string]func() WaitStrategy {
+	return map[string]func() WaitStrategy{
+		"BusySpin":     func() WaitStrategy { return NewBusySpin() },
+		"SpinYield":    func() WaitStrategy { return NewSpinYield(16) },
+		"SpinPark":     func() WaitStrategy { return NewSpinPark(16) },
+		"TimedBackoff": func() WaitStrategy { return NewTimedBackoff(time.Microsecond, time.Millisecond) },
+	}
+}
+
+func TestSPSCWaitStrategies(t *testing.T) {
+	const N = 2000
+
+	for nm, mk := range testStrategies() {
+		t.Run(nm, func(t *testing.T) {
+			assert := newAsserter(t)
+
+			ws := mk()
+			q := NewSPSCQ(64, WithWaitStrategy[int](ws))
+
+			errch := make(chan error, 1)
+			go func() {
+				for i := 0; i < N; i++ {
+					if err := q.EnqWait(context.Background(), i); err != nil {
+						errch <- err
+						return
+					}
+				}
+				errch <- q.Close()
+			}()
+
+			for i := 0; i < N; i++ {
+				z, err := q.DeqTimeout(5 * time.Second)
+				assert(err == nil, "deq-%d: %v", i, err)
+				assert(z == i, "deq: exp %d, saw %d", i, z)
+			}
+			_, err := q.DeqTimeout(5 * time.Second)
+			assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+
+			err = <-errch
+			assert(err == nil, "producer: %v", err)
+			t.Logf("%s: %d parks", nm, ws.Parks())
+		})
+	}
+}
+
+func TestSPSCWaitTimeout(t *testing.T) {
+	for nm, mk := range testStrategies() {
+		t.Run(nm, func(t *testing.T) {
+			assert := newAsserter(t)
+
+			q := NewSPSCQ(1, WithWaitStrategy[int](mk()))
+
+			_, err := q.DeqTimeout(10 * time.Millisecond)
+			assert(errors.Is(err, context.DeadlineExceeded), "deq: exp timeout, saw %v", err)
+
+			assert(q.Enq(1), "enq-1 failed")
+			err = q.EnqTimeout(2, 10*time.Millisecond)
+			assert(errors.Is(err, context.DeadlineExceeded), "enq: exp timeout, saw %v", err)
+		})
+	}
+}
+
+func TestSPSCWaitClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	ws := NewSpinPark(0)
+	q := NewSPSCQ(4, WithWaitStrategy[int](ws))
+
+	// a parked consumer must be woken up by Close
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Close()
+	}()
+	_, err := q.DeqTimeout(5 * time.Second)
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+	assert(ws.Parks() > 0, "exp consumer to park")
+
+	// a parked producer must be woken up by Close
+	ws = NewSpinPark(0)
+	q = NewSPSCQ(1, WithWaitStrategy[int](ws), WithPolicy[int](Block))
+	assert(q.Enq(1), "enq-1 failed")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Close()
+	}()
+	assert(!q.Enq(2), "enq on closed queue succeeded")
+	assert(ws.Parks() > 0, "exp producer to park")
+
+	// the remaining element is still delivered
+	z, err := q.DeqWait(context.Background())
+	assert(err == nil && z == 1, "deq: exp 1, saw %d %v", z, err)
+	_, err = q.DeqWait(context.Background())
+	assert(errors.Is(err, ErrClosed), "deq: exp ErrClosed, saw %v", err)
+
+	assert(NewBusySpin().Parks() == 0, "busy spin parked")
+}
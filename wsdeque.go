@@ -0,0 +1,190 @@
+// wsdeque.go - Lock-free work-stealing deque
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Placed in the Public Domain
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package utils
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Notes:
+//   - this is the Chase-Lev deque ("Dynamic Circular Work-Stealing
+//     Deque", SPAA 2005) with the fixes from Le et al. (PPoPP 2013)
+//   - top and bot are free running counters; the deque holds the
+//     elements [top, bot). The owner works at 'bot', stealers at 'top'.
+//   - Go atomics are sequentially consistent; this provides the
+//     store-load fence that Pop() needs between writing 'bot' and
+//     reading 'top'.
+//   - the slots hold pointers so that a stealer reading a slot never
+//     races with the owner overwriting it. This costs an allocation
+//     per Push.
+//   - Pop clears the slot of the element it wins. Steal can't: once
+//     'top' moves, the slot belongs to the owner. A stolen element
+//     stays reachable from its slot until the owner pushes into that
+//     slot again.
+//   - the owner grows the ring by copying the live elements to a
+//     ring twice the size; stealers still holding the old ring read
+//     the same elements from it.
+
+// WSDeque[T] is a generic, growable, lock-free work-stealing deque.
+// The owner go-routine pushes and pops elements at the bottom of
+// the deque (LIFO) and any number of other go-routines steal
+// elements from the top (FIFO). Push and Pop must only be called by
+// the owner; Steal can be called from any go-routine.
+type WSDeque[T any] struct {
+	top atomic.Int64
+	_   [7]uint64 // cache-line pad
+
+	bot atomic.Int64
+	_   [7]uint64 // cache-line pad
+
+	ring atomic.Pointer[wsRing[T]]
+}
+
+type wsRing[T any] struct {
+	mask int64
+	v    []atomic.Pointer[T]
+}
+
+// Make a new work-stealing deque with initial room for (at least)
+// 'n' elements. If 'n' is NOT a power-of-2, this function will pick
+// the next closest power-of-2. The deque grows as needed.
+func NewWSDeque[T any](n int) *WSDeque[T] {
+	z := nextpow2(uint64(max(n, 1))) //#nosec G115 -- checked above
+
+	d := &WSDeque[T]{}
+	d.ring.Store(newWSRing[T](int64(z))) //#nosec G115 -- 64-bit platforms
+	return d
+}
+
+func newWSRing[T any](z int64) *wsRing[T] {
+	return &wsRing[T]{
+		mask: z - 1,
+		v:    make([]atomic.Pointer[T], z),
+	}
+}
+
+func (r *wsRing[T]) get(i int64) *T {
+	return r.v[i&r.mask].Load()
+}
+
+func (r *wsRing[T]) put(i int64, p *T) {
+	r.v[i&r.mask].Store(p)
+}
+
+// grow returns a ring twice the size with the elements [t, b)
+func (r *wsRing[T]) grow(t, b int64) *wsRing[T] {
+	n := newWSRing[T](2 * (r.mask + 1))
+	for i := t; i < b; i++ {
+		n.put(i, r.get(i))
+	}
+	return n
+}
+
+// Push adds a new element to the bottom of the deque, growing the
+// deque if needed. Each Push allocates a copy of 'x'. Only the owner
+// may call Push.
+func (d *WSDeque[T]) Push(x T) {
+	b := d.bot.Load()
+	t := d.top.Load()
+	r := d.ring.Load()
+
+	if b-t > r.mask {
+		r = r.grow(t, b)
+		d.ring.Store(r)
+	}
+
+	r.put(b, &x)
+	d.bot.Store(b + 1)
+}
+
+// Pop removes the most recently pushed element from the bottom of
+// the deque; it returns false if the deque is empty. Only the owner
+// may call Pop.
+func (d *WSDeque[T]) Pop() (T, bool) {
+	var z T
+
+	b := d.bot.Load() - 1
+	r := d.ring.Load()
+	d.bot.Store(b)
+
+	t := d.top.Load()
+	if t > b {
+		// deque was empty
+		d.bot.Store(b + 1)
+		return z, false
+	}
+
+	p := r.get(b)
+	if t == b {
+		// last element: race the stealers for it
+		ok := d.top.CompareAndSwap(t, t+1)
+		d.bot.Store(b + 1)
+		if !ok {
+			return z, false
+		}
+	}
+
+	// the element is ours; don't keep it reachable from the ring
+	r.put(b, nil)
+	return *p, true
+}
+
+// Steal removes the oldest element from the top of the deque; it
+// returns false if the deque is empty. Steal is safe to call from
+// any go-routine. The deque holds on to a stolen element until the
+// owner reuses its slot.
+func (d *WSDeque[T]) Steal() (T, bool) {
+	for {
+		t := d.top.Load()
+		b := d.bot.Load()
+		if t >= b {
+			var z T
+			return z, false
+		}
+
+		// read the element before claiming it; once 'top' moves,
+		// the owner is free to reuse the slot.
+		p := d.ring.Load().get(t)
+		if d.top.CompareAndSwap(t, t+1) {
+			return *p, true
+		}
+		// lost the race to another stealer or the owner
+	}
+}
+
+// Len returns the number of elements in the deque. In the presence
+// of concurrent stealers, this is only a snapshot.
+func (d *WSDeque[T]) Len() int {
+	t := d.top.Load()
+	b := d.bot.Load()
+	return int(max(b-t, 0))
+}
+
+// IsEmpty returns true if the deque is empty
+func (d *WSDeque[T]) IsEmpty() bool {
+	return d.Len() == 0
+}
+
+// Size returns the current capacity of the deque
+func (d *WSDeque[T]) Size() int {
+	return int(d.ring.Load().mask + 1)
+}
+
+// String returns a human readable description of the deque
+func (d *WSDeque[T]) String() string {
+	t := d.top.Load()
+	b := d.bot.Load()
+
+	return fmt.Sprintf("<WSDeque %T cap=%d len=%d top=%d bot=%d>",
+		d, d.Size(), max(b-t, 0), t, b)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
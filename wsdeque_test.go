@@ -0,0 +1,146 @@
+// wsdeque_test.go - tests for the work-stealing deque
+
+package utils
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWSDeque(t *testing.T) {
+	assert := newAsserter(t)
+
+	d := NewWSDeque[int](2)
+	assert(d.Size() == 2, "size: exp 2, saw %d", d.Size())
+	assert(d.IsEmpty(), "expected deque to be empty")
+
+	_, ok := d.Pop()
+	assert(!ok, "pop on empty deque")
+	_, ok = d.Steal()
+	assert(!ok, "steal on empty deque")
+
+	// grow a few times
+	for i := 0; i < 10; i++ {
+		d.Push(i)
+	}
+	assert(d.Len() == 10, "len: exp 10, saw %d", d.Len())
+	assert(d.Size() == 16, "size: exp 16, saw %d", d.Size())
+
+	// owner is LIFO, stealers are FIFO
+	z, ok := d.Pop()
+	assert(ok && z == 9, "pop: exp 9, saw %d", z)
+	z, ok = d.Steal()
+	assert(ok && z == 0, "steal: exp 0, saw %d", z)
+	z, ok = d.Steal()
+	assert(ok && z == 1, "steal: exp 1, saw %d", z)
+
+	for i := 8; i >= 2; i-- {
+		z, ok := d.Pop()
+		assert(ok && z == i, "pop: exp %d, saw %d", i, z)
+	}
+	assert(d.IsEmpty(), "expected deque to be empty\n%s", d)
+
+	// wrap around the ring without growing it
+	for i := 0; i < 100; i++ {
+		d.Push(i)
+		d.Push(i + 1)
+		z, ok := d.Steal()
+		assert(ok && z == i, "steal: exp %d, saw %d", i, z)
+		z, ok = d.Pop()
+		assert(ok && z == i+1, "pop: exp %d, saw %d", i+1, z)
+	}
+	assert(d.Size() == 16, "size: exp 16, saw %d", d.Size())
+}
+
+func TestWSDequeRelease(t *testing.T) {
+	assert := newAsserter(t)
+
+	d := NewWSDeque[*int](4)
+	for i := 0; i < 4; i++ {
+		v := i
+		d.Push(&v)
+	}
+
+	// Pop must not keep the popped element reachable
+	r := d.ring.Load()
+	z, ok := d.Pop()
+	assert(ok && *z == 3, "pop: exp 3, saw %v", z)
+	z, ok = d.Steal()
+	assert(ok && *z == 0, "steal: exp 0, saw %v", z)
+	for d.Len() > 1 {
+		d.Pop()
+	}
+
+	// the last element is won with a CAS
+	z, ok = d.Pop()
+	assert(ok && *z == 1, "pop: exp 1, saw %v", z)
+	for i := 1; i < 4; i++ {
+		assert(r.get(int64(i)) == nil, "slot %d not cleared after pop", i)
+	}
+}
+
+// TestWSDequeStress has an owner push and pop while several stealers
+// steal; every task must be seen exactly once.
+func TestWSDequeStress(t *testing.T) {
+	assert := newAsserter(t)
+
+	const N = 50000
+	const thieves = 4
+
+	d := NewWSDeque[int](4)
+	seen := make([]atomic.Int32, N)
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+
+	wg.Add(thieves)
+	for i := 0; i < thieves; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				if x, ok := d.Steal(); ok {
+					seen[x].Add(1)
+					continue
+				}
+				if done.Load() {
+					return
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	for i := 0; i < N; i++ {
+		d.Push(i)
+
+		// the owner consumes some of its own work
+		if i%3 == 0 {
+			if x, ok := d.Pop(); ok {
+				seen[x].Add(1)
+			}
+		}
+
+		// give the stealers a chance on a single CPU
+		if i%64 == 0 {
+			runtime.Gosched()
+		}
+	}
+	for {
+		x, ok := d.Pop()
+		if !ok {
+			break
+		}
+		seen[x].Add(1)
+	}
+
+	done.Store(true)
+	wg.Wait()
+
+	assert(d.IsEmpty(), "expected deque to be empty\n%s", d)
+	for i := range seen {
+		n := seen[i].Load()
+		assert(n == 1, "task %d: seen %d times", i, n)
+	}
+}